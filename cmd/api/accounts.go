@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the broker acts for users without a fresh login when they use api keys, refresh tokens or wallets.
+// With AUTH_USER_PATH set their account is looked up at the auth service then, so users who were
+// demoted, disabled or deleted lose what they no longer hold. Lookups are cached briefly to keep busy
+// api keys cheap. Without it the broker goes by what it stored at the last login
+var errAccountUnavailable = errors.New("account no longer exists or is disabled")
+
+type cachedAccount struct {
+	principal Principal
+	at        time.Time
+}
+
+type accountCache struct {
+	mu       sync.Mutex
+	TTL      time.Duration
+	accounts map[string]cachedAccount
+}
+
+var accounts = &accountCache{
+	TTL:      envDuration("ACCOUNT_CACHE_TTL", time.Minute),
+	accounts: map[string]cachedAccount{},
+}
+
+func (c *accountCache) get(userID string) (*Principal, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := c.accounts[userID]
+	if !ok || time.Since(cached.at) > c.TTL {
+		return nil, false
+	}
+	principal := cached.principal
+	return &principal, true
+}
+
+func (c *accountCache) put(principal *Principal) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for userID, cached := range c.accounts {
+		if now.Sub(cached.at) > c.TTL {
+			delete(c.accounts, userID)
+		}
+	}
+	c.accounts[principal.UserID] = cachedAccount{principal: *principal, at: now}
+}
+
+// forget drops the cached account, the next lookup asks the auth service again
+func (c *accountCache) forget(userID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.accounts, userID)
+}
+
+// resolveAccount returns the user as the auth service knows them now, with their current email and
+// roles. It fails with errAccountUnavailable for accounts that are gone or disabled. known is what the
+// broker stored for the user, it is returned as it is when AUTH_USER_PATH is unset
+func (app *Config) resolveAccount(ctx context.Context, known *Principal) (*Principal, error) {
+	path := os.Getenv("AUTH_USER_PATH")
+	if path == "" {
+		return known, nil
+	}
+
+	userID := known.UserID
+	if principal, ok := accounts.get(userID); ok {
+		return principal, nil
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "GET", os.Getenv("AUTH_URL")+path+url.PathEscape(userID), nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if token := os.Getenv("AUTH_SERVICE_TOKEN"); token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusGone {
+		return nil, errAccountUnavailable
+	}
+
+	// a 404 only says the user is gone when the auth service answers it, a missing route or a proxy
+	// in between answers it too
+	var jsonFromService jsonResponse
+	err = json.NewDecoder(response.Body).Decode(&jsonFromService)
+	if response.StatusCode == http.StatusNotFound {
+		if err == nil && jsonFromService.Error {
+			return nil, errAccountUnavailable
+		}
+		return nil, errors.New("auth service has no account lookup at " + path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode >= 300 || jsonFromService.Error {
+		return nil, errors.New("auth service could not look up the account: " + jsonFromService.Message)
+	}
+
+	principal, err := principalFromData(jsonFromService.Data)
+	if err != nil {
+		return nil, err
+	}
+	if principal.UserID != userID || accountDisabled(principal.Claims) {
+		return nil, errAccountUnavailable
+	}
+
+	accounts.put(principal)
+	return principal, nil
+}
+
+// accountDisabled reads the usual ways a user record says it may not sign in
+func accountDisabled(claims map[string]any) bool {
+	for _, key := range []string{"disabled", "deleted", "banned", "suspended", "locked"} {
+		if value, _ := claims[key].(bool); value {
+			return true
+		}
+	}
+	for _, key := range []string{"active", "is_active", "enabled"} {
+		if value, ok := claims[key].(bool); ok && !value {
+			return true
+		}
+	}
+	switch strings.ToLower(firstString(claims, "status")) {
+	case "disabled", "deleted", "banned", "suspended", "inactive", "locked":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	apiKeysBucket = "api_keys"
+	apiKeyHeader  = "X-API-Key"
+	apiKeyPrefix  = "sbk"
+
+	// last_used_at is only written back this often to keep authenticated requests read only
+	apiKeyTouchInterval = time.Minute
+)
+
+var errAPIKeyNotFound = errors.New("api key not found")
+
+type CreateAPIKeyPayload struct {
+	Name          string   `json:"name" validate:"required,max=64"`
+	Scopes        []string `json:"scopes,omitempty" validate:"max=16"`
+	ExpiresInDays int      `json:"expires_in_days,omitempty" validate:"min=0,max=3650"`
+}
+
+// apiKey is stored keyed by its prefix, the secret part of the key is only kept as a sha256 hash. Roles
+// is what the owner held when the key was created, requests run with the roles the owner holds now
+// when the auth service can be asked for them
+type apiKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Hash       string     `json:"hash,omitempty"`
+	UserID     string     `json:"user_id"`
+	Email      string     `json:"email,omitempty"`
+	Roles      []string   `json:"roles,omitempty"`
+	Scopes     []string   `json:"scopes,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	RotatedTo  string     `json:"rotated_to,omitempty"`
+}
+
+func (k *apiKey) active(now time.Time) bool {
+	return k.RevokedAt == nil && (k.ExpiresAt == nil || now.Before(*k.ExpiresAt))
+}
+
+// public strips the hash before a key is returned to a client
+func (k apiKey) public() apiKey {
+	k.Hash = ""
+	return k
+}
+
+// hashSecret is how api keys and refresh tokens are stored, only their sha256 is kept
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIKey generates a key of the form sbk_<prefix>_<secret>, the prefix identifies it in listings
+func newAPIKey(owner *Principal, name string, scopes []string, expiresAt *time.Time) (apiKey, string, error) {
+	prefix, err := randomString(16)
+	if err != nil {
+		return apiKey{}, "", err
+	}
+	secret, err := randomString(24)
+	if err != nil {
+		return apiKey{}, "", err
+	}
+
+	plain := fmt.Sprintf("%s_%s_%s", apiKeyPrefix, prefix, secret)
+	key := apiKey{
+		ID:        prefix,
+		Name:      name,
+		Prefix:    fmt.Sprintf("%s_%s", apiKeyPrefix, prefix),
+		Hash:      hashSecret(plain),
+		UserID:    owner.UserID,
+		Email:     owner.Email,
+		Roles:     owner.Roles,
+		Scopes:    scopes,
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: expiresAt,
+	}
+	return key, plain, nil
+}
+
+// authenticateAPIKey resolves the principal of an X-API-Key header
+func (app *Config) authenticateAPIKey(ctx context.Context, plain string) (*Principal, error) {
+	parts := strings.Split(plain, "_")
+	if len(parts) != 3 || parts[0] != apiKeyPrefix {
+		return nil, errors.New("malformed api key")
+	}
+
+	var key apiKey
+	found, err := app.Store.get(apiKeysBucket, parts[1], &key)
+	if err != nil {
+		return nil, err
+	}
+	if !found || subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hashSecret(plain))) != 1 {
+		return nil, errors.New("invalid api key")
+	}
+
+	now := time.Now().UTC()
+	if !key.active(now) {
+		return nil, errors.New("api key has expired or was revoked")
+	}
+
+	// the key acts with what its owner holds today, not what they held when it was created
+	owner, err := app.resolveAccount(ctx, &Principal{UserID: key.UserID, Email: key.Email, Roles: key.Roles})
+	if err != nil {
+		return nil, err
+	}
+
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) > apiKeyTouchInterval {
+		key.LastUsedAt = &now
+		_ = app.Store.put(apiKeysBucket, key.ID, key)
+	}
+
+	return &Principal{
+		UserID:   key.UserID,
+		Email:    owner.Email,
+		Roles:    owner.Roles,
+		Scopes:   key.Scopes,
+		APIKeyID: key.ID,
+	}, nil
+}
+
+// ownedAPIKey loads the key of the {id} url param, making sure it belongs to the principal
+func (app *Config) ownedAPIKey(r *http.Request, principal *Principal) (apiKey, error) {
+	var key apiKey
+	found, err := app.Store.get(apiKeysBucket, chi.URLParam(r, "id"), &key)
+	if err != nil {
+		return apiKey{}, err
+	}
+	if !found || key.UserID != principal.UserID {
+		return apiKey{}, errAPIKeyNotFound
+	}
+	return key, nil
+}
+
+// keyManager returns the principal when it may manage api keys, keys can't be used to mint more keys
+func (app *Config) keyManager(w http.ResponseWriter, r *http.Request) (*Principal, bool) {
+	principal, ok := principalFrom(r.Context())
+	if !ok {
+		app.errorJSON(w, errors.New("unauthorized"), nil, http.StatusUnauthorized)
+		return nil, false
+	}
+	if principal.APIKeyID != "" {
+		app.errorJSON(w, errors.New("api keys can only be managed with a bearer token"), nil, http.StatusForbidden)
+		return nil, false
+	}
+	return principal, true
+}
+
+func (app *Config) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	principal, ok := app.keyManager(w, r)
+	if !ok {
+		return
+	}
+
+	var requestPayload CreateAPIKeyPayload
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, nil)
+		return
+	}
+
+	// a key can never do more than its owner
+	for _, scope := range requestPayload.Scopes {
+		if !app.Policy.can(principal, scope) {
+			app.errorJSON(w, fmt.Errorf("you don't hold the permission %s", scope), map[string]string{"scopes": scope}, http.StatusForbidden)
+			return
+		}
+	}
+
+	var expiresAt *time.Time
+	if requestPayload.ExpiresInDays > 0 {
+		expiry := time.Now().UTC().AddDate(0, 0, requestPayload.ExpiresInDays)
+		expiresAt = &expiry
+	}
+
+	key, plain, err := newAPIKey(principal, strings.TrimSpace(requestPayload.Name), requestPayload.Scopes, expiresAt)
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+
+	//never replace a key that happens to have the same id
+	err = app.Store.insert(apiKeysBucket, key.ID, key)
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+
+	app.audit(r, auditEvent{Type: "api_key.created", Outcome: outcomeSuccess,
+		Detail: map[string]string{"key_id": key.ID, "scopes": strings.Join(key.Scopes, ",")}})
+
+	var payload jsonResponse
+	payload.Error = false
+	payload.StatusCode = http.StatusCreated
+	payload.Message = "api key created, store it now as it can't be shown again"
+	payload.Data = map[string]any{"key": plain, "api_key": key.public()}
+
+	app.writeJSON(w, http.StatusCreated, payload)
+}
+
+func (app *Config) ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	principal, ok := app.keyManager(w, r)
+	if !ok {
+		return
+	}
+
+	keys := []apiKey{}
+	err := app.Store.each(apiKeysBucket, func(_ string, value []byte) error {
+		var key apiKey
+		if err := json.Unmarshal(value, &key); err != nil {
+			return err
+		}
+		if key.UserID == principal.UserID {
+			keys = append(keys, key.public())
+		}
+		return nil
+	})
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.After(keys[j].CreatedAt) })
+
+	var payload jsonResponse
+	payload.Error = false
+	payload.StatusCode = http.StatusOK
+	payload.Message = "api keys"
+	payload.Data = keys
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+func (app *Config) RotateAPIKey(w http.ResponseWriter, r *http.Request) {
+	principal, ok := app.keyManager(w, r)
+	if !ok {
+		return
+	}
+
+	old, err := app.ownedAPIKey(r, principal)
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusNotFound)
+		return
+	}
+	if !old.active(time.Now()) {
+		app.errorJSON(w, errors.New("api key has expired or was revoked"), nil, http.StatusConflict)
+		return
+	}
+
+	key, plain, err := newAPIKey(principal, old.Name, old.Scopes, old.ExpiresAt)
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+
+	err = app.Store.insert(apiKeysBucket, key.ID, key)
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now().UTC()
+	old.RevokedAt = &now
+	old.RotatedTo = key.ID
+	err = app.Store.put(apiKeysBucket, old.ID, old)
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+
+	app.audit(r, auditEvent{Type: "api_key.rotated", Outcome: outcomeSuccess,
+		Detail: map[string]string{"key_id": key.ID, "previous_key_id": old.ID}})
+
+	var payload jsonResponse
+	payload.Error = false
+	payload.StatusCode = http.StatusOK
+	payload.Message = "api key rotated, the previous key no longer works"
+	payload.Data = map[string]any{"key": plain, "api_key": key.public()}
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+func (app *Config) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	principal, ok := app.keyManager(w, r)
+	if !ok {
+		return
+	}
+
+	key, err := app.ownedAPIKey(r, principal)
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusNotFound)
+		return
+	}
+
+	if key.RevokedAt == nil {
+		now := time.Now().UTC()
+		key.RevokedAt = &now
+		err = app.Store.put(apiKeysBucket, key.ID, key)
+		if err != nil {
+			app.errorJSON(w, err, nil, http.StatusInternalServerError)
+			return
+		}
+		app.audit(r, auditEvent{Type: "api_key.revoked", Outcome: outcomeSuccess, Detail: map[string]string{"key_id": key.ID}})
+	}
+
+	var payload jsonResponse
+	payload.Error = false
+	payload.StatusCode = http.StatusOK
+	payload.Message = "api key revoked"
+	payload.Data = key.public()
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
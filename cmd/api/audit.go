@@ -0,0 +1,481 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+const auditBucket = "audit_log"
+
+// events waiting to be written, once the buffer is full further events are dropped and counted
+// rather than hold up the requests that record them. The count goes into the chain as a gap entry
+const auditBufferSize = 1024
+
+// the log is read this many entries at a time, each page in its own read transaction
+const auditPageSize = 500
+
+// a batch the store refused is written again after this long, doubling up to auditRetryMax
+const (
+	auditRetryMin = time.Second
+	auditRetryMax = time.Minute
+)
+
+// the hash of an entry is an hmac keyed with AUDIT_HMAC_KEY, so it can't be recomputed by someone
+// who can only write to the database
+const auditHashHMAC = "hmac-sha256"
+
+const (
+	auditRequest     = "request"
+	auditAdmin       = "admin"
+	auditAuthFailure = "auth.failure"
+	auditLogin       = "auth.login"
+	auditSignup      = "auth.signup"
+	auditRefresh     = "auth.refresh"
+	auditGap         = "audit.gap"
+)
+
+const (
+	outcomeSuccess = "success"
+	outcomeFailure = "failure"
+	outcomeDenied  = "denied"
+)
+
+// auditEvent is one entry of the audit log. Hash covers the entry and the hash of the entry before
+// it, so changing or removing any entry breaks the chain from there on. HashAlg says how Hash was made
+type auditEvent struct {
+	Seq       uint64            `json:"seq"`
+	At        time.Time         `json:"at"`
+	Type      string            `json:"type"`
+	Actor     string            `json:"actor,omitempty"`
+	APIKeyID  string            `json:"api_key_id,omitempty"`
+	Email     string            `json:"email,omitempty"`
+	IP        string            `json:"ip,omitempty"`
+	UserAgent string            `json:"user_agent,omitempty"`
+	Method    string            `json:"method,omitempty"`
+	Path      string            `json:"path,omitempty"`
+	Status    int               `json:"status,omitempty"`
+	Outcome   string            `json:"outcome"`
+	Detail    map[string]string `json:"detail,omitempty"`
+	PrevHash  string            `json:"prev_hash"`
+	HashAlg   string            `json:"hash_alg,omitempty"`
+	Hash      string            `json:"hash"`
+}
+
+// chainHash is the hmac of the event without its own hash together with the hash of the previous event
+func (e auditEvent) chainHash(key []byte) string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	data = append([]byte(e.PrevHash+"\n"), data...)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// auditLog appends events to the store in the background, in batches
+type auditLog struct {
+	events  chan auditEvent
+	key     []byte
+	dropped atomic.Uint64
+}
+
+// newAuditLog keys the chain with AUDIT_HMAC_KEY, falling back to BROKER_JWT_SECRET. It returns nil
+// without either, anyone who can write the database could rewrite an unkeyed log unnoticed, so
+// nothing is audited then
+func newAuditLog() *auditLog {
+	key := os.Getenv("AUDIT_HMAC_KEY")
+	if key == "" {
+		key = os.Getenv("BROKER_JWT_SECRET")
+	}
+	if key == "" {
+		return nil
+	}
+	return &auditLog{events: make(chan auditEvent, auditBufferSize), key: []byte(key)}
+}
+
+// run writes whatever events have queued up in one transaction at a time
+func (a *auditLog) run(store *Store) {
+	for event := range a.events {
+		batch := []auditEvent{event}
+		// events dropped since the last batch leave a gap entry, so the chain itself shows they are missing
+		if dropped := a.dropped.Swap(0); dropped > 0 {
+			gap := auditEvent{At: time.Now().UTC(), Type: auditGap, Outcome: outcomeFailure,
+				Detail: map[string]string{"dropped": strconv.FormatUint(dropped, 10)}}
+			batch = []auditEvent{gap, event}
+		}
+	drain:
+		for len(batch) < auditBufferSize {
+			select {
+			case event := <-a.events:
+				batch = append(batch, event)
+			default:
+				break drain
+			}
+		}
+
+		// a store that fails now may work again later, nothing is dropped for it
+		for wait := auditRetryMin; ; wait = min(wait*2, auditRetryMax) {
+			err := a.write(store, batch)
+			if err == nil {
+				break
+			}
+			log.Println("error writing audit events, retrying in", wait, err)
+			time.Sleep(wait)
+		}
+	}
+}
+
+// write chains batch onto the log in one transaction
+func (a *auditLog) write(store *Store, batch []auditEvent) error {
+	return store.append(auditBucket, len(batch), func(i int, seq uint64, previous []byte) (any, error) {
+		event := batch[i]
+		event.Seq = seq
+		if previous != nil {
+			var last auditEvent
+			if err := json.Unmarshal(previous, &last); err != nil {
+				return nil, err
+			}
+			event.PrevHash = last.Hash
+		}
+		event.HashAlg = auditHashHMAC
+		event.Hash = event.chainHash(a.key)
+		return event, nil
+	})
+}
+
+// record queues event without ever blocking, a full buffer drops it and counts it instead. A nil log
+// records nothing
+func (a *auditLog) record(event auditEvent) {
+	if a == nil {
+		return
+	}
+	select {
+	case a.events <- event:
+	default:
+		if dropped := a.dropped.Add(1); dropped == 1 || dropped%1000 == 0 {
+			log.Println("audit buffer is full, events dropped since the last write:", dropped)
+		}
+	}
+}
+
+// audit records event, filling in who made the request and from where
+func (app *Config) audit(r *http.Request, event auditEvent) {
+	event.At = time.Now().UTC()
+	event.IP = clientIP(r)
+	event.UserAgent = r.UserAgent()
+	if event.Method == "" {
+		event.Method, event.Path = r.Method, r.URL.Path
+	}
+	if principal, ok := principalFrom(r.Context()); ok {
+		if event.Actor == "" {
+			event.Actor = principal.UserID
+		}
+		if event.Email == "" {
+			event.Email = principal.Email
+		}
+		event.APIKeyID = principal.APIKeyID
+	}
+
+	app.Audit.record(event)
+}
+
+// auditRequests records every authenticated request with its outcome, admin routes as admin events
+func (app *Config) auditRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		event := auditEvent{Type: auditRequest, Status: status, Outcome: outcomeSuccess}
+		if strings.HasPrefix(r.URL.Path, "/api/v1/admin/") {
+			event.Type = auditAdmin
+		}
+		switch {
+		case status == http.StatusUnauthorized || status == http.StatusForbidden || status == http.StatusTooManyRequests:
+			event.Outcome = outcomeDenied
+		case status >= 400:
+			event.Outcome = outcomeFailure
+		}
+		app.audit(r, event)
+	})
+}
+
+// rejectAuth answers a request whose credentials were not accepted and records why
+func (app *Config) rejectAuth(w http.ResponseWriter, r *http.Request, err error, data any, status int) {
+	method := "token"
+	if r.Header.Get(apiKeyHeader) != "" {
+		method = "api_key"
+	}
+	app.audit(r, auditEvent{Type: auditAuthFailure, Status: status, Outcome: outcomeDenied,
+		Detail: map[string]string{"reason": err.Error(), "credential": method}})
+	app.errorJSON(w, err, data, status)
+}
+
+// auditFilter selects events by the query parameters type, actor, ip, outcome, from and to
+type auditFilter struct {
+	Type, Actor, IP, Outcome string
+	From, To                 time.Time
+	After                    uint64
+}
+
+func auditFilterFromQuery(r *http.Request) (auditFilter, error) {
+	query := r.URL.Query()
+	filter := auditFilter{
+		Type:    query.Get("type"),
+		Actor:   query.Get("actor"),
+		IP:      query.Get("ip"),
+		Outcome: query.Get("outcome"),
+	}
+
+	var err error
+	if from := query.Get("from"); from != "" {
+		if filter.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return filter, errors.New("from must be an RFC 3339 time")
+		}
+	}
+	if to := query.Get("to"); to != "" {
+		if filter.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return filter, errors.New("to must be an RFC 3339 time")
+		}
+	}
+	if after := query.Get("after"); after != "" {
+		if filter.After, err = strconv.ParseUint(after, 10, 64); err != nil {
+			return filter, errors.New("after must be a sequence number")
+		}
+	}
+	return filter, nil
+}
+
+func (f auditFilter) match(e auditEvent) bool {
+	switch {
+	case e.Seq <= f.After:
+		return false
+	case f.Type != "" && e.Type != f.Type && !strings.HasPrefix(e.Type, f.Type+"."):
+		return false
+	case f.Actor != "" && e.Actor != f.Actor:
+		return false
+	case f.IP != "" && e.IP != f.IP:
+		return false
+	case f.Outcome != "" && e.Outcome != f.Outcome:
+		return false
+	case !f.From.IsZero() && e.At.Before(f.From):
+		return false
+	case !f.To.IsZero() && e.At.After(f.To):
+		return false
+	}
+	return true
+}
+
+// eachAuditEvent calls fn with every event in the order they were appended until fn returns false.
+// fn runs outside of any transaction, so it may write to slow clients
+func (app *Config) eachAuditEvent(fn func(auditEvent) bool) error {
+	after := ""
+	for {
+		values, last, err := app.Store.page(auditBucket, after, auditPageSize)
+		if err != nil {
+			return err
+		}
+		for _, value := range values {
+			var event auditEvent
+			if err := json.Unmarshal(value, &event); err != nil {
+				return err
+			}
+			if !fn(event) {
+				return nil
+			}
+		}
+		if len(values) < auditPageSize {
+			return nil
+		}
+		after = last
+	}
+}
+
+// auditEnabled answers with a 404 when the broker has no key to chain the log with
+func (app *Config) auditEnabled(w http.ResponseWriter) bool {
+	if app.Audit == nil {
+		app.errorJSON(w, errors.New("audit log is not enabled, set AUDIT_HMAC_KEY"), nil, http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// QueryAudit returns up to ?limit= matching events after the sequence number ?after=, oldest first
+func (app *Config) QueryAudit(w http.ResponseWriter, r *http.Request) {
+	if !app.auditEnabled(w) {
+		return
+	}
+
+	filter, err := auditFilterFromQuery(r)
+	if err != nil {
+		app.errorJSON(w, err, nil)
+		return
+	}
+
+	limit := 100
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+
+	events := []auditEvent{}
+	err = app.eachAuditEvent(func(event auditEvent) bool {
+		if filter.match(event) {
+			events = append(events, event)
+		}
+		return len(events) < limit
+	})
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+
+	result := map[string]any{"events": events}
+	if len(events) == limit {
+		result["next_after"] = events[len(events)-1].Seq
+	}
+
+	var payload jsonResponse
+	payload.Error = false
+	payload.StatusCode = http.StatusOK
+	payload.Message = "audit events"
+	payload.Data = result
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+// ExportAudit streams every matching event, as json lines or with ?format=csv
+func (app *Config) ExportAudit(w http.ResponseWriter, r *http.Request) {
+	if !app.auditEnabled(w) {
+		return
+	}
+
+	filter, err := auditFilterFromQuery(r)
+	if err != nil {
+		app.errorJSON(w, err, nil)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "jsonl"
+	}
+	if format != "jsonl" && format != "csv" {
+		app.errorJSON(w, errors.New("format must be jsonl or csv"), nil)
+		return
+	}
+
+	filename := fmt.Sprintf("audit-%s.%s", time.Now().UTC().Format("20060102T150405Z"), format)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+
+	if format == "jsonl" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		encoder := json.NewEncoder(w)
+		err = app.eachAuditEvent(func(event auditEvent) bool {
+			if filter.match(event) {
+				encoder.Encode(event)
+			}
+			return true
+		})
+	} else {
+		w.Header().Set("Content-Type", "text/csv")
+		w.WriteHeader(http.StatusOK)
+		out := csv.NewWriter(w)
+		out.Write([]string{"seq", "at", "type", "actor", "api_key_id", "email", "ip", "user_agent", "method", "path", "status", "outcome", "detail", "prev_hash", "hash"})
+		err = app.eachAuditEvent(func(event auditEvent) bool {
+			if filter.match(event) {
+				detail, _ := json.Marshal(event.Detail)
+				out.Write([]string{
+					strconv.FormatUint(event.Seq, 10), event.At.Format(time.RFC3339Nano), event.Type, event.Actor,
+					event.APIKeyID, event.Email, event.IP, event.UserAgent, event.Method, event.Path,
+					strconv.Itoa(event.Status), event.Outcome, string(detail), event.PrevHash, event.Hash,
+				})
+			}
+			return true
+		})
+		out.Flush()
+	}
+
+	// the status has already gone out, all that is left is to note the export was cut short
+	if err != nil {
+		log.Println("error exporting audit log", err)
+	}
+}
+
+// VerifyAudit walks the whole chain and reports the first entry that doesn't match its hash
+func (app *Config) VerifyAudit(w http.ResponseWriter, r *http.Request) {
+	if !app.auditEnabled(w) {
+		return
+	}
+
+	var (
+		count    uint64
+		dropped  uint64
+		previous string
+		broken   *auditEvent
+		reason   string
+	)
+	err := app.eachAuditEvent(func(event auditEvent) bool {
+		count++
+		switch {
+		case event.Seq != count:
+			reason = "sequence number is out of order, entries were removed or reordered"
+		case event.PrevHash != previous:
+			reason = "previous hash does not match, an entry before it was changed or removed"
+		case event.HashAlg != auditHashHMAC:
+			reason = "entry is not keyed, it was rewritten"
+		case event.chainHash(app.Audit.key) != event.Hash:
+			reason = "hash does not match the contents of the entry"
+		default:
+			previous = event.Hash
+			if event.Type == auditGap {
+				n, _ := strconv.ParseUint(event.Detail["dropped"], 10, 64)
+				dropped += n
+			}
+			return true
+		}
+		broken = &event
+		return false
+	})
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+
+	// dropped events are those the gap entries account for and any not written down yet
+	result := map[string]any{"valid": broken == nil, "verified": count, "head": previous,
+		"dropped_events": dropped + app.Audit.dropped.Load()}
+	if broken != nil {
+		result["verified"] = count - 1
+		result["broken_at"] = broken.Seq
+		result["reason"] = reason
+	}
+
+	var payload jsonResponse
+	payload.Error = false
+	payload.StatusCode = http.StatusOK
+	payload.Message = "audit log verified"
+	if broken != nil {
+		payload.Message = "audit log has been tampered with"
+	}
+	payload.Data = result
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
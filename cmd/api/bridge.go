@@ -0,0 +1,502 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	stateSyncedTopic     = "0x103fed9db65eac19c4d870f49ab7520fe03b99f1838e5996caf47e9e43308392"
+	lastStateIDSelector  = "0x5407ca67"
+	stateReceiverAddress = "0x0000000000000000000000000000000000001001"
+)
+
+// deposit stages, in the order a deposit moves through them
+const (
+	depositSubmitted        = "submitted"
+	depositL1Confirmed      = "l1_confirmed"
+	depositHeimdallRecorded = "heimdall_recorded"
+	depositBorCommitted     = "bor_committed"
+	depositFailed           = "failed"
+)
+
+type TrackDepositPayload struct {
+	TxHash string `json:"tx_hash" validate:"required,tx_hash"`
+}
+
+// bridgeStage records when a tracked transfer reached a stage
+type bridgeStage struct {
+	Stage string    `json:"stage"`
+	At    time.Time `json:"at"`
+}
+
+type depositStatus struct {
+	Network       string        `json:"network"`
+	TxHash        string        `json:"tx_hash"`
+	Stage         string        `json:"stage"`
+	StateID       uint64        `json:"state_id,omitempty"`
+	L1BlockNumber uint64        `json:"l1_block_number,omitempty"`
+	Stages        []bridgeStage `json:"stages"`
+	Error         string        `json:"error,omitempty"`
+	TrackedAt     time.Time     `json:"tracked_at"`
+	UpdatedAt     time.Time     `json:"updated_at"`
+}
+
+// advance moves the deposit to stage, keeping the time it was first reached
+func (d *depositStatus) advance(stage string, at time.Time) {
+	for _, s := range d.Stages {
+		if s.Stage == stage {
+			return
+		}
+	}
+	d.Stage = stage
+	d.Stages = append(d.Stages, bridgeStage{Stage: stage, At: at.UTC()})
+}
+
+func (d *depositStatus) final() bool {
+	return d.Stage == depositBorCommitted || d.Stage == depositFailed
+}
+
+var (
+	errTrackerFull      = errors.New("the broker is tracking as many bridge transfers as it can, try again later")
+	errTooManyTransfers = errors.New("you are already tracking as many bridge transfers as allowed")
+)
+
+// bridgeTracker keeps the bridge transfers users asked the broker to follow and refreshes them in the background.
+// Every transfer has the users following it with the webhook each of them asked for, users only see
+// the transfers they follow and only their own webhook
+type bridgeTracker struct {
+	mu          sync.Mutex
+	deposits    map[string]*depositStatus
+	withdrawals map[string]*withdrawalStatus
+	watchers    map[string]map[string]string
+
+	// MaxTransfers caps the transfers tracked for everyone together, MaxPerUser those of a single user
+	MaxTransfers int
+	MaxPerUser   int
+	// PendingTTL is how long a transaction may stay unmined before it is given up on, Retention how
+	// long transfers are kept once they reached a final stage
+	PendingTTL time.Duration
+	Retention  time.Duration
+}
+
+func newBridgeTracker() *bridgeTracker {
+	return &bridgeTracker{
+		deposits:     map[string]*depositStatus{},
+		withdrawals:  map[string]*withdrawalStatus{},
+		watchers:     map[string]map[string]string{},
+		MaxTransfers: envInt("BRIDGE_MAX_TRACKED", 10000),
+		MaxPerUser:   envInt("BRIDGE_MAX_TRACKED_PER_USER", 50),
+		PendingTTL:   envDuration("BRIDGE_PENDING_TTL", 24*time.Hour),
+		Retention:    envDuration("BRIDGE_RETENTION", 7*24*time.Hour),
+	}
+}
+
+func trackerKey(network, txHash string) string {
+	return network + ":" + normalizeTxHash(txHash)
+}
+
+// watcherKey tells deposits and withdrawals apart in the watchers
+func watcherKey(kind, key string) string {
+	return kind + ":" + key
+}
+
+// watch makes userID follow a transfer, a new transfer is only taken on while the caps allow it. An
+// empty webhook keeps the one the user gave before. The caller holds the lock
+func (t *bridgeTracker) watch(key, userID, webhook string) error {
+	users, tracked := t.watchers[key]
+	if _, ok := users[userID]; ok {
+		if webhook != "" {
+			users[userID] = webhook
+		}
+		return nil
+	}
+	if !tracked && len(t.watchers) >= t.MaxTransfers {
+		return errTrackerFull
+	}
+
+	following := 0
+	for _, users := range t.watchers {
+		if _, ok := users[userID]; ok {
+			following++
+		}
+	}
+	if following >= t.MaxPerUser {
+		return errTooManyTransfers
+	}
+
+	if !tracked {
+		users = map[string]string{}
+		t.watchers[key] = users
+	}
+	users[userID] = webhook
+	return nil
+}
+
+// watching reports whether userID follows the deposit or withdrawal of txHash
+func (t *bridgeTracker) watching(kind, network, txHash, userID string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.watchers[watcherKey(kind, trackerKey(network, txHash))][userID]
+	return ok
+}
+
+// webhook returns the webhook userID gave for the withdrawal of txHash
+func (t *bridgeTracker) webhook(network, txHash, userID string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.watchers[watcherKey("withdrawal", trackerKey(network, txHash))][userID]
+}
+
+// webhooks returns the webhooks of everyone following the withdrawal of txHash
+func (t *bridgeTracker) webhooks(network, txHash string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var urls []string
+	for _, url := range t.watchers[watcherKey("withdrawal", trackerKey(network, txHash))] {
+		if url != "" {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
+func (t *bridgeTracker) deposit(network, txHash string) (depositStatus, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d, ok := t.deposits[trackerKey(network, txHash)]
+	if !ok {
+		return depositStatus{}, false
+	}
+	return *d, true
+}
+
+// trackDeposit stores the deposit and makes userID follow it
+func (t *bridgeTracker) trackDeposit(d depositStatus, userID string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := trackerKey(d.Network, d.TxHash)
+	if err := t.watch(watcherKey("deposit", key), userID, ""); err != nil {
+		return err
+	}
+	t.deposits[key] = &d
+	return nil
+}
+
+// saveDeposit updates a deposit that is still tracked
+func (t *bridgeTracker) saveDeposit(d depositStatus) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := trackerKey(d.Network, d.TxHash)
+	if _, ok := t.deposits[key]; ok {
+		t.deposits[key] = &d
+	}
+}
+
+// pendingDeposits returns a copy of every deposit that has not reached a final stage
+func (t *bridgeTracker) pendingDeposits() []depositStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var pending []depositStatus
+	for _, d := range t.deposits {
+		if !d.final() {
+			pending = append(pending, *d)
+		}
+	}
+	return pending
+}
+
+func (t *bridgeTracker) withdrawal(network, txHash string) (withdrawalStatus, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	wd, ok := t.withdrawals[trackerKey(network, txHash)]
+	if !ok {
+		return withdrawalStatus{}, false
+	}
+	return *wd, true
+}
+
+// trackWithdrawal stores the withdrawal and makes userID follow it, notified on webhook when set
+func (t *bridgeTracker) trackWithdrawal(wd withdrawalStatus, userID, webhook string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := trackerKey(wd.Network, wd.TxHash)
+	if err := t.watch(watcherKey("withdrawal", key), userID, webhook); err != nil {
+		return err
+	}
+	t.withdrawals[key] = &wd
+	return nil
+}
+
+// saveWithdrawal updates a withdrawal that is still tracked
+func (t *bridgeTracker) saveWithdrawal(wd withdrawalStatus) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := trackerKey(wd.Network, wd.TxHash)
+	if _, ok := t.withdrawals[key]; ok {
+		t.withdrawals[key] = &wd
+	}
+}
+
+// pendingWithdrawals returns a copy of every withdrawal that has not reached a final stage
+func (t *bridgeTracker) pendingWithdrawals() []withdrawalStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var pending []withdrawalStatus
+	for _, wd := range t.withdrawals {
+		if !wd.final() {
+			pending = append(pending, *wd)
+		}
+	}
+	return pending
+}
+
+// prune forgets the transfers that reached a final stage longer than Retention ago
+func (t *bridgeTracker) prune(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, d := range t.deposits {
+		if d.final() && now.Sub(d.UpdatedAt) > t.Retention {
+			delete(t.deposits, key)
+			delete(t.watchers, watcherKey("deposit", key))
+		}
+	}
+	for key, wd := range t.withdrawals {
+		if wd.final() && now.Sub(wd.UpdatedAt) > t.Retention {
+			delete(t.withdrawals, key)
+			delete(t.watchers, watcherKey("withdrawal", key))
+		}
+	}
+}
+
+// run refreshes pending transfers on every tick until the process exits
+func (t *bridgeTracker) run(networks map[string]*posNetwork, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		t.prune(time.Now())
+
+		for _, d := range t.pendingDeposits() {
+			// a transaction that never gets mined would otherwise be polled forever
+			if d.StateID == 0 && time.Since(d.TrackedAt) > t.PendingTTL {
+				d.UpdatedAt = time.Now().UTC()
+				d.Error = fmt.Sprintf("deposit transaction was not mined within %s", t.PendingTTL)
+				d.advance(depositFailed, d.UpdatedAt)
+				t.saveDeposit(d)
+				continue
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			refreshed, err := refreshDeposit(ctx, networks[d.Network], d)
+			cancel()
+			if err != nil {
+				log.Println("error refreshing deposit", d.TxHash, err)
+				continue
+			}
+			t.saveDeposit(refreshed)
+		}
+
+		for _, wd := range t.pendingWithdrawals() {
+			if wd.BlockNumber == 0 && time.Since(wd.TrackedAt) > t.PendingTTL {
+				expired := wd
+				expired.UpdatedAt = time.Now().UTC()
+				expired.Error = fmt.Sprintf("burn transaction was not mined within %s", t.PendingTTL)
+				expired.advance(withdrawalFailed, expired.UpdatedAt)
+				t.saveWithdrawal(expired)
+				notifyStageChange(wd, expired, t.webhooks(wd.Network, wd.TxHash))
+				continue
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			refreshed, err := refreshWithdrawal(ctx, networks[wd.Network], wd)
+			cancel()
+			if err != nil {
+				log.Println("error refreshing withdrawal", wd.TxHash, err)
+				continue
+			}
+			t.saveWithdrawal(refreshed)
+			notifyStageChange(wd, refreshed, t.webhooks(wd.Network, wd.TxHash))
+		}
+	}
+}
+
+func (app *Config) TrackDeposit(w http.ResponseWriter, r *http.Request) {
+
+	network, err := app.network(r)
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusNotFound)
+		return
+	}
+
+	var requestPayload TrackDepositPayload
+	err = app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, nil)
+		return
+	}
+
+	principal, _ := principalFrom(r.Context())
+	d, ok := app.Bridge.deposit(network.Name, requestPayload.TxHash)
+	if !ok {
+		d = depositStatus{Network: network.Name, TxHash: normalizeTxHash(requestPayload.TxHash), TrackedAt: time.Now().UTC()}
+		d.advance(depositSubmitted, d.TrackedAt)
+	}
+
+	d, err = refreshDeposit(r.Context(), network, d)
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusBadGateway)
+		return
+	}
+	err = app.Bridge.trackDeposit(d, principal.UserID)
+	if err != nil {
+		app.errorJSON(w, err, nil, trackingErrorStatus(err))
+		return
+	}
+
+	var payload jsonResponse
+	payload.Error = false
+	payload.StatusCode = http.StatusAccepted
+	payload.Message = fmt.Sprintf("deposit is being tracked, current stage: %s", d.Stage)
+	payload.Data = d
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+func (app *Config) GetDeposit(w http.ResponseWriter, r *http.Request) {
+
+	network, err := app.network(r)
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusNotFound)
+		return
+	}
+
+	//users only see the transfers they track themselves
+	principal, _ := principalFrom(r.Context())
+	d, ok := app.Bridge.deposit(network.Name, chi.URLParam(r, "txHash"))
+	if !ok || !app.Bridge.watching("deposit", network.Name, d.TxHash, principal.UserID) {
+		app.errorJSON(w, errors.New("deposit is not being tracked, submit it first"), nil, http.StatusNotFound)
+		return
+	}
+
+	if !d.final() {
+		refreshed, err := refreshDeposit(r.Context(), network, d)
+		if err == nil {
+			d = refreshed
+			app.Bridge.saveDeposit(d)
+		}
+	}
+
+	var payload jsonResponse
+	payload.Error = false
+	payload.StatusCode = http.StatusOK
+	payload.Message = fmt.Sprintf("current stage: %s", d.Stage)
+	payload.Data = d
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+// trackingErrorStatus is the status for an error of the tracker caps
+func trackingErrorStatus(err error) int {
+	if errors.Is(err, errTrackerFull) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusTooManyRequests
+}
+
+// refreshDeposit follows a deposit from the ethereum transaction through the StateSynced event,
+// the heimdall clerk record and finally the state commit on bor
+func refreshDeposit(ctx context.Context, network *posNetwork, d depositStatus) (depositStatus, error) {
+	if network == nil {
+		return d, fmt.Errorf("unknown network %s", d.Network)
+	}
+	if network.EthRPCURL == "" {
+		return d, fmt.Errorf("no ethereum rpc endpoint configured for %s", network.Name)
+	}
+	d.UpdatedAt = time.Now().UTC()
+
+	if d.StateID == 0 {
+		var receipt *struct {
+			Status      string `json:"status"`
+			BlockNumber string `json:"blockNumber"`
+			Logs        []struct {
+				Address string   `json:"address"`
+				Topics  []string `json:"topics"`
+			} `json:"logs"`
+		}
+		err := rpcCall(ctx, network.EthRPCURL, "eth_getTransactionReceipt", []any{d.TxHash}, &receipt)
+		if err != nil {
+			return d, err
+		}
+
+		// still waiting to be mined on L1
+		if receipt == nil {
+			return d, nil
+		}
+
+		if receipt.Status == "0x0" {
+			d.Error = "deposit transaction reverted on L1"
+			d.advance(depositFailed, d.UpdatedAt)
+			return d, nil
+		}
+
+		for _, l := range receipt.Logs {
+			if strings.EqualFold(l.Address, network.StateSenderAddress) && len(l.Topics) > 1 && strings.EqualFold(l.Topics[0], stateSyncedTopic) {
+				d.StateID, _ = hexUint64(l.Topics[1])
+				break
+			}
+		}
+		if d.StateID == 0 {
+			d.Error = "transaction did not emit a StateSynced event, it is not a bridge deposit"
+			d.advance(depositFailed, d.UpdatedAt)
+			return d, nil
+		}
+
+		d.L1BlockNumber, _ = hexUint64(receipt.BlockNumber)
+		var l1Block struct {
+			Timestamp string `json:"timestamp"`
+		}
+		confirmedAt := d.UpdatedAt
+		err = rpcCall(ctx, network.EthRPCURL, "eth_getBlockByNumber", []any{receipt.BlockNumber, false}, &l1Block)
+		if err == nil {
+			if ts, err := hexUint64(l1Block.Timestamp); err == nil {
+				confirmedAt = time.Unix(int64(ts), 0)
+			}
+		}
+		d.advance(depositL1Confirmed, confirmedAt)
+	}
+
+	// heimdall picks the event up once the L1 block is final enough
+	var record struct {
+		ID         flexUint  `json:"id"`
+		RecordTime time.Time `json:"record_time"`
+	}
+	err := heimdallGet(ctx, network, fmt.Sprintf("clerk/event-record/%d", d.StateID), &record)
+	if err != nil || record.ID == 0 {
+		return d, nil
+	}
+	recordedAt := record.RecordTime
+	if recordedAt.IsZero() {
+		recordedAt = d.UpdatedAt
+	}
+	d.advance(depositHeimdallRecorded, recordedAt)
+
+	// the deposit lands once the bor state receiver has committed its state id
+	out, err := ethCall(ctx, network.BorRPCURL, stateReceiverAddress, lastStateIDSelector)
+	if err != nil {
+		return d, nil
+	}
+	if wordToUint64(abiWord(out, 0)) >= d.StateID {
+		d.advance(depositBorCommitted, d.UpdatedAt)
+	}
+
+	return d, nil
+}
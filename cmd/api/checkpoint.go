@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// rootchain checkpoints are stored under header block ids that step by this interval
+	checkpointInterval = 10000
+
+	headerBlocksSelector = "0x41539d4a"
+	newHeaderBlockTopic  = "0xba5de06d22af2685c6c7765f60067f7d2b08c2d29f53cdf14d67f6d1c9bfb527"
+)
+
+type checkpointDetails struct {
+	ID         uint64    `json:"id"`
+	StartBlock uint64    `json:"start_block"`
+	EndBlock   uint64    `json:"end_block"`
+	RootHash   string    `json:"root_hash"`
+	Proposer   string    `json:"proposer"`
+	BorChainID string    `json:"bor_chain_id"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+type l1Submission struct {
+	HeaderBlockID   uint64    `json:"header_block_id"`
+	RootHash        string    `json:"root_hash"`
+	StartBlock      uint64    `json:"start_block"`
+	EndBlock        uint64    `json:"end_block"`
+	Proposer        string    `json:"proposer"`
+	CreatedAt       time.Time `json:"created_at"`
+	TransactionHash string    `json:"transaction_hash,omitempty"`
+	L1BlockNumber   uint64    `json:"l1_block_number,omitempty"`
+}
+
+type checkpointInclusion struct {
+	Network               string             `json:"network"`
+	BlockNumber           uint64             `json:"block_number"`
+	TransactionHash       string             `json:"transaction_hash,omitempty"`
+	Included              bool               `json:"included"`
+	LastCheckpointedBlock uint64             `json:"last_checkpointed_block"`
+	CheckpointID          uint64             `json:"checkpoint_id,omitempty"`
+	Checkpoint            *checkpointDetails `json:"checkpoint,omitempty"`
+	L1Submission          *l1Submission      `json:"l1_submission,omitempty"`
+}
+
+func (app *Config) CheckpointInclusion(w http.ResponseWriter, r *http.Request) {
+
+	network, err := app.network(r)
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusNotFound)
+		return
+	}
+
+	block, txHash, err := blockFromQuery(r, network)
+	if err != nil {
+		app.errorJSON(w, err, nil)
+		return
+	}
+
+	inclusion, err := app.checkpointInclusion(r.Context(), network, block)
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusBadGateway)
+		return
+	}
+	inclusion.TransactionHash = txHash
+
+	var payload jsonResponse
+	payload.Error = false
+	payload.StatusCode = http.StatusOK
+	payload.Message = "block is not yet included in a checkpoint"
+	if inclusion.Included {
+		payload.Message = fmt.Sprintf("block is included in checkpoint %d", inclusion.CheckpointID)
+	}
+	payload.Data = inclusion
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+// checkpointInclusion reports whether block is covered by a checkpoint and where it was submitted on L1
+func (app *Config) checkpointInclusion(ctx context.Context, network *posNetwork, block uint64) (*checkpointInclusion, error) {
+	inclusion := &checkpointInclusion{Network: network.Name, BlockNumber: block}
+
+	cp, lastCheckpointed, err := findCheckpoint(ctx, network, block)
+	inclusion.LastCheckpointedBlock = lastCheckpointed
+	if errors.Is(err, errBlockNotCheckpointed) {
+		return inclusion, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	inclusion.Included = true
+	inclusion.CheckpointID = cp.ID
+	inclusion.Checkpoint = &checkpointDetails{
+		ID:         cp.ID,
+		StartBlock: uint64(cp.StartBlock),
+		EndBlock:   uint64(cp.EndBlock),
+		RootHash:   cp.RootHash,
+		Proposer:   cp.Proposer,
+		BorChainID: cp.BorChainID,
+		Timestamp:  time.Unix(int64(cp.Timestamp), 0).UTC(),
+	}
+
+	// the L1 details are best effort, they need an ethereum rpc endpoint to be configured
+	if network.EthRPCURL != "" {
+		submission, err := rootChainSubmission(ctx, network, cp.ID)
+		if err == nil {
+			inclusion.L1Submission = submission
+		}
+	}
+
+	return inclusion, nil
+}
+
+type checkpointProof struct {
+	Network         string   `json:"network"`
+	BlockNumber     uint64   `json:"block_number"`
+	TransactionHash string   `json:"transaction_hash,omitempty"`
+	CheckpointID    uint64   `json:"checkpoint_id"`
+	StartBlock      uint64   `json:"start_block"`
+	EndBlock        uint64   `json:"end_block"`
+	RootHash        string   `json:"root_hash"`
+	ComputedRoot    string   `json:"computed_root"`
+	Leaf            string   `json:"leaf"`
+	LeafIndex       int      `json:"leaf_index"`
+	Proof           []string `json:"proof"`
+	Verified        bool     `json:"verified"`
+}
+
+func (app *Config) CheckpointProof(w http.ResponseWriter, r *http.Request) {
+
+	network, err := app.network(r)
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusNotFound)
+		return
+	}
+
+	block, txHash, err := blockFromQuery(r, network)
+	if err != nil {
+		app.errorJSON(w, err, nil)
+		return
+	}
+
+	cp, _, err := findCheckpoint(r.Context(), network, block)
+	if errors.Is(err, errBlockNotCheckpointed) {
+		app.errorJSON(w, err, nil, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusBadGateway)
+		return
+	}
+
+	tree, err := checkpointTree(r.Context(), network, cp)
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusBadGateway)
+		return
+	}
+
+	index := int(block - uint64(cp.StartBlock))
+	leaf := tree.levels[0][index]
+	proof := tree.proof(index)
+
+	expectedRoot, err := decodeHex(cp.RootHash)
+	if err != nil {
+		app.errorJSON(w, fmt.Errorf("checkpoint %d has an invalid root hash", cp.ID), nil, http.StatusBadGateway)
+		return
+	}
+
+	proofPayload := checkpointProof{
+		Network:         network.Name,
+		BlockNumber:     block,
+		TransactionHash: txHash,
+		CheckpointID:    cp.ID,
+		StartBlock:      uint64(cp.StartBlock),
+		EndBlock:        uint64(cp.EndBlock),
+		RootHash:        cp.RootHash,
+		ComputedRoot:    fmt.Sprintf("0x%x", tree.root()),
+		Leaf:            fmt.Sprintf("0x%x", leaf),
+		LeafIndex:       index,
+		Verified:        verifyMerkleProof(leaf, index, proof, expectedRoot),
+	}
+	for _, sibling := range proof {
+		proofPayload.Proof = append(proofPayload.Proof, fmt.Sprintf("0x%x", sibling))
+	}
+
+	var payload jsonResponse
+	payload.Error = !proofPayload.Verified
+	payload.StatusCode = http.StatusOK
+	payload.Message = fmt.Sprintf("block verified against the root hash of checkpoint %d", cp.ID)
+	if !proofPayload.Verified {
+		payload.StatusCode = http.StatusConflict
+		payload.Message = fmt.Sprintf("computed root does not match the root hash of checkpoint %d", cp.ID)
+	}
+	payload.Data = proofPayload
+
+	app.writeJSON(w, payload.StatusCode, payload)
+}
+
+// blockFromQuery resolves the block to look up from either the block or the tx query parameter
+func blockFromQuery(r *http.Request, network *posNetwork) (uint64, string, error) {
+	txHash := r.URL.Query().Get("tx")
+	blockParam := r.URL.Query().Get("block")
+
+	if txHash != "" {
+		if !isTxHash(txHash) {
+			return 0, "", errors.New("tx must be a 32 byte hex transaction hash")
+		}
+		txHash = normalizeTxHash(txHash)
+		block, err := borTransactionBlock(r.Context(), network, txHash)
+		return block, txHash, err
+	}
+
+	if blockParam == "" {
+		return 0, "", errors.New("either block or tx query parameter is required")
+	}
+
+	block, err := strconv.ParseUint(blockParam, 10, 64)
+	if err != nil {
+		return 0, "", errors.New("block must be a positive integer")
+	}
+	return block, "", nil
+}
+
+// borTransactionBlock returns the bor block a transaction was mined in
+func borTransactionBlock(ctx context.Context, network *posNetwork, txHash string) (uint64, error) {
+	var receipt *struct {
+		BlockNumber string `json:"blockNumber"`
+	}
+	err := rpcCall(ctx, network.BorRPCURL, "eth_getTransactionReceipt", []any{txHash}, &receipt)
+	if err != nil {
+		return 0, err
+	}
+	if receipt == nil || receipt.BlockNumber == "" {
+		return 0, errors.New("transaction not found or still pending on bor")
+	}
+	return hexUint64(receipt.BlockNumber)
+}
+
+// rootChainSubmission reads the header block of a checkpoint from the rootchain contract on L1
+func rootChainSubmission(ctx context.Context, network *posNetwork, checkpointID uint64) (*l1Submission, error) {
+	headerBlockID := checkpointID * checkpointInterval
+
+	out, err := ethCall(ctx, network.EthRPCURL, network.RootChainAddress, headerBlocksSelector+abiUint(headerBlockID))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) < 5*32 {
+		return nil, fmt.Errorf("unexpected headerBlocks response for checkpoint %d", checkpointID)
+	}
+
+	submission := &l1Submission{
+		HeaderBlockID: headerBlockID,
+		RootHash:      fmt.Sprintf("0x%x", abiWord(out, 0)),
+		StartBlock:    wordToUint64(abiWord(out, 1)),
+		EndBlock:      wordToUint64(abiWord(out, 2)),
+		CreatedAt:     time.Unix(int64(wordToUint64(abiWord(out, 3))), 0).UTC(),
+		Proposer:      wordToAddress(abiWord(out, 4)),
+	}
+
+	// look up the NewHeaderBlock event for the submission transaction, not every provider allows it
+	var logs []struct {
+		TransactionHash string `json:"transactionHash"`
+		BlockNumber     string `json:"blockNumber"`
+	}
+	filter := map[string]any{
+		"fromBlock": "earliest",
+		"toBlock":   "latest",
+		"address":   network.RootChainAddress,
+		"topics":    []any{newHeaderBlockTopic, nil, "0x" + abiUint(headerBlockID)},
+	}
+	if err := rpcCall(ctx, network.EthRPCURL, "eth_getLogs", []any{filter}, &logs); err == nil && len(logs) > 0 {
+		submission.TransactionHash = logs[0].TransactionHash
+		submission.L1BlockNumber, _ = hexUint64(logs[0].BlockNumber)
+	}
+
+	return submission, nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	_ "embed"
+	"errors"
+	"net/mail"
+	"os"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+//go:embed disposable_domains.txt
+var disposableDomainList string
+
+// disposableDomains is the bundled list, plus any in the comma separated DISPOSABLE_DOMAINS
+var disposableDomains = loadDisposableDomains()
+
+var errInvalidEmail = errors.New("must be a valid email address")
+
+// callingPlan is how the phone numbers of a country are written, Lengths are the valid lengths of
+// the national number without the trunk prefix
+type callingPlan struct {
+	Code    string
+	Lengths []int
+	Trunk   string
+}
+
+// callingPlans by ISO 3166 country code, numbers of other countries are only checked against E.164
+var callingPlans = map[string]callingPlan{
+	"AE": {"971", []int{8, 9}, "0"},
+	"AU": {"61", []int{9}, "0"},
+	"BR": {"55", []int{10, 11}, "0"},
+	"CA": {"1", []int{10}, "1"},
+	"CN": {"86", []int{10, 11}, "0"},
+	"DE": {"49", []int{7, 8, 9, 10, 11}, "0"},
+	"EG": {"20", []int{9, 10}, "0"},
+	"ES": {"34", []int{9}, ""},
+	"FR": {"33", []int{9}, "0"},
+	"GB": {"44", []int{9, 10}, "0"},
+	"GH": {"233", []int{9}, "0"},
+	"IE": {"353", []int{7, 8, 9}, "0"},
+	"IN": {"91", []int{10}, "0"},
+	"IT": {"39", []int{6, 7, 8, 9, 10, 11}, ""},
+	"JP": {"81", []int{9, 10}, "0"},
+	"KE": {"254", []int{9}, "0"},
+	"MX": {"52", []int{10}, ""},
+	"NG": {"234", []int{8, 10}, "0"},
+	"NL": {"31", []int{9}, "0"},
+	"PH": {"63", []int{10}, "0"},
+	"PK": {"92", []int{9, 10}, "0"},
+	"RU": {"7", []int{10}, "8"},
+	"SA": {"966", []int{8, 9}, "0"},
+	"SG": {"65", []int{8}, ""},
+	"TR": {"90", []int{10}, "0"},
+	"US": {"1", []int{10}, "1"},
+	"ZA": {"27", []int{9}, "0"},
+}
+
+func loadDisposableDomains() map[string]bool {
+	domains := map[string]bool{}
+	scanner := bufio.NewScanner(strings.NewReader(disposableDomainList))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			domains[strings.ToLower(line)] = true
+		}
+	}
+	for _, domain := range strings.Split(os.Getenv("DISPOSABLE_DOMAINS"), ",") {
+		if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+			domains[domain] = true
+		}
+	}
+	return domains
+}
+
+// canonicalEmail parses a bare address and returns it lowercased with its domain in ascii, so
+// Ann@Bücher.Example and ann@xn--bcher-kva.example are the same account
+func canonicalEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email {
+		return "", errInvalidEmail
+	}
+
+	at := strings.LastIndex(email, "@")
+	local, domain := email[:at], strings.TrimSuffix(email[at+1:], ".")
+	if local == "" || len(local) > 64 {
+		return "", errInvalidEmail
+	}
+
+	domain, err = idna.Lookup.ToASCII(domain)
+	if err != nil || len(domain) > 253 {
+		return "", errInvalidEmail
+	}
+
+	labels := strings.Split(domain, ".")
+	if len(labels) < 2 {
+		return "", errInvalidEmail
+	}
+	for _, label := range labels {
+		if !isHostLabel(label) {
+			return "", errInvalidEmail
+		}
+	}
+
+	// top level domains are letters only, or punycode for internationalized ones
+	tld := labels[len(labels)-1]
+	if !strings.HasPrefix(tld, "xn--") && (len(tld) < 2 || strings.IndexFunc(tld, func(r rune) bool { return r < 'a' || r > 'z' }) >= 0) {
+		return "", errInvalidEmail
+	}
+
+	return strings.ToLower(local) + "@" + domain, nil
+}
+
+func isHostLabel(label string) bool {
+	if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+		return false
+	}
+	for _, r := range label {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// isDisposableEmail reports whether a canonical address belongs to a listed domain or a subdomain of one
+func isDisposableEmail(email string) bool {
+	domain := email[strings.LastIndex(email, "@")+1:]
+	for {
+		if disposableDomains[domain] {
+			return true
+		}
+		_, parent, ok := strings.Cut(domain, ".")
+		if !ok {
+			return false
+		}
+		domain = parent
+	}
+}
+
+// normalizePhone returns the number in E.164. Numbers written without a country code, like
+// 0801 234 5678, are read as numbers of country. Errors are a *codedError about the phone field
+func normalizePhone(phone, country string) (string, error) {
+	digits := strings.Map(func(r rune) rune {
+		switch {
+		case r >= '0' && r <= '9', r == '+':
+			return r
+		case r == ' ', r == '-', r == '.', r == '(', r == ')':
+			return -1
+		}
+		return 'x'
+	}, strings.TrimSpace(phone))
+	if strings.ContainsRune(digits, 'x') || strings.LastIndex(digits, "+") > 0 {
+		return "", newCodedError("phone.invalid_characters", "field", "phone")
+	}
+
+	// 00 is the international prefix in most of the world
+	if strings.HasPrefix(digits, "00") {
+		digits = "+" + digits[2:]
+	}
+
+	if !strings.HasPrefix(digits, "+") {
+		country = strings.ToUpper(strings.TrimSpace(country))
+		if country == "" {
+			return "", newCodedError("phone.country_required", "field", "phone")
+		}
+		plan, ok := callingPlans[country]
+		if !ok {
+			return "", newCodedError("phone.unknown_country", "field", "phone", "country", country)
+		}
+		if plan.Trunk != "" && !plan.fits(digits) {
+			digits = strings.TrimPrefix(digits, plan.Trunk)
+		}
+		if !plan.fits(digits) {
+			return "", newCodedError("phone.invalid_for_country", "field", "phone", "country", country)
+		}
+		return "+" + plan.Code + digits, nil
+	}
+
+	if !e164Regex.MatchString(digits) {
+		return "", newCodedError("validation.e164", "field", "phone")
+	}
+
+	// check the national number against the plan of its country when we know it
+	if code, plan, ok := planFor(digits[1:]); ok && !plan.fits(digits[1+len(code):]) {
+		return "", newCodedError("phone.invalid_for_code", "field", "phone", "code", code)
+	}
+	return digits, nil
+}
+
+func (p callingPlan) fits(national string) bool {
+	for _, length := range p.Lengths {
+		if len(national) == length {
+			return true
+		}
+	}
+	return false
+}
+
+// planFor finds the plan of an international number by the longest matching country code
+func planFor(number string) (string, callingPlan, bool) {
+	for size := 3; size >= 1; size-- {
+		if len(number) <= size {
+			continue
+		}
+		for _, plan := range callingPlans {
+			if plan.Code == number[:size] {
+				return plan.Code, plan, true
+			}
+		}
+	}
+	return "", callingPlan{}, false
+}
+
+// normalizeSignupContact canonicalizes the email and phone of the payload in place, rejecting
+// disposable mailboxes and numbers that can't be normalized
+func normalizeSignupContact(payload *SignupPayload) error {
+	var failed []fieldError
+
+	email, err := canonicalEmail(payload.Email)
+	switch {
+	case err != nil:
+		failed = append(failed, newFieldError("email", "email", "", "validation.email"))
+	case os.Getenv("BLOCK_DISPOSABLE_EMAILS") != "false" && isDisposableEmail(email):
+		failed = append(failed, newFieldError("email", "disposable", "", "email.disposable"))
+	default:
+		payload.Email = email
+	}
+
+	country := payload.Country
+	if country == "" {
+		country = os.Getenv("DEFAULT_PHONE_COUNTRY")
+	}
+	phone, err := normalizePhone(payload.Phone, country)
+	var coded *codedError
+	if errors.As(err, &coded) {
+		failed = append(failed, fieldError{Field: "phone", Rule: "e164", Code: coded.Code, Message: coded.Error(), params: coded.Params})
+	} else {
+		payload.Phone = phone
+	}
+
+	if len(failed) > 0 {
+		return &validationError{Fields: failed}
+	}
+
+	// the country only helps read the phone, the auth service gets the normalized number
+	payload.Country = ""
+	return nil
+}
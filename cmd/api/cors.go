@@ -0,0 +1,169 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/cors"
+)
+
+// origins allowed when CORS_ALLOWED_ORIGINS is unset, production allows none
+var corsProfileOrigins = map[string][]string{
+	"development": {"http://localhost:*", "http://127.0.0.1:*"},
+	"production":  {},
+}
+
+// corsGroups are matched by path prefix in order, the last one catches everything else
+var corsGroups = []struct {
+	Name   string
+	Prefix string
+}{
+	{"admin", "/api/v1/admin/"},
+	{"auth", "/api/v1/authentication/"},
+	{"default", "/"},
+}
+
+// corsPolicy is the cors configuration of one route group
+type corsPolicy struct {
+	Name             string
+	Prefix           string
+	Origins          []string
+	AllowCredentials bool
+	MaxAge           int
+
+	cors *cors.Cors
+}
+
+// corsConfig holds a policy per route group for the profile the broker runs with
+type corsConfig struct {
+	Profile  string
+	Policies []*corsPolicy
+}
+
+// loadCORSConfig reads APP_ENV (development or production, the default), CORS_ALLOWED_ORIGINS, a comma
+// separated allowlist where an origin may hold one wildcard like https://*.example.com, and
+// CORS_<GROUP>_ALLOWED_ORIGINS overriding it for the admin, auth or default group
+func loadCORSConfig() *corsConfig {
+	profile := strings.ToLower(envOr("APP_ENV", "production"))
+	defaults, ok := corsProfileOrigins[profile]
+	if !ok {
+		log.Println("unknown APP_ENV", profile, "using the production cors profile")
+		profile, defaults = "production", corsProfileOrigins["production"]
+	}
+
+	base := defaults
+	if origins, ok := os.LookupEnv("CORS_ALLOWED_ORIGINS"); ok {
+		base = splitOrigins(origins)
+	}
+
+	config := &corsConfig{Profile: profile}
+	for _, group := range corsGroups {
+		policy := &corsPolicy{
+			Name:             group.Name,
+			Prefix:           group.Prefix,
+			Origins:          base,
+			AllowCredentials: os.Getenv("CORS_ALLOW_CREDENTIALS") != "false",
+			MaxAge:           envInt("CORS_MAX_AGE", 300),
+		}
+		if origins, ok := os.LookupEnv("CORS_" + strings.ToUpper(group.Name) + "_ALLOWED_ORIGINS"); ok {
+			policy.Origins = splitOrigins(origins)
+		}
+
+		// a credentialed request from any site is exactly what cors is there to prevent
+		for _, origin := range policy.Origins {
+			if origin == "*" {
+				if profile == "production" {
+					log.Println("cors group", group.Name, "allows every origin in production")
+				}
+				policy.AllowCredentials = false
+			}
+		}
+
+		policy.cors = cors.New(cors.Options{
+			AllowOriginFunc:  func(_ *http.Request, origin string) bool { return policy.allows(origin) },
+			AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+			AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", csrfHeader, apiKeyHeader},
+			ExposedHeaders:   []string{"Link", "Retry-After", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "X-Quota-Limit", "X-Quota-Remaining", "X-Quota-Reset"},
+			AllowCredentials: policy.AllowCredentials,
+			MaxAge:           policy.MaxAge,
+		})
+		config.Policies = append(config.Policies, policy)
+	}
+
+	return config
+}
+
+func splitOrigins(list string) []string {
+	origins := []string{}
+	for _, origin := range strings.Split(list, ",") {
+		if origin = strings.ToLower(strings.TrimSpace(origin)); origin != "" {
+			origins = append(origins, strings.TrimSuffix(origin, "/"))
+		}
+	}
+	return origins
+}
+
+// allows matches origin against the allowlist, a single * in an entry stands for any characters
+func (p *corsPolicy) allows(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, allowed := range p.Origins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+		if prefix, suffix, ok := strings.Cut(allowed, "*"); ok {
+			if len(origin) >= len(prefix)+len(suffix) && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *corsConfig) policyFor(path string) *corsPolicy {
+	for _, policy := range c.Policies {
+		if strings.HasPrefix(path, policy.Prefix) {
+			return policy
+		}
+	}
+	return c.Policies[len(c.Policies)-1]
+}
+
+// handler applies the policy of the group the path belongs to. Preflights never match a route, so
+// this runs on the top level mux rather than as middleware of the groups
+func (c *corsConfig) handler(next http.Handler) http.Handler {
+	handlers := map[string]http.Handler{}
+	for _, policy := range c.Policies {
+		handlers[policy.Name] = policy.cors.Handler(next)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlers[c.policyFor(r.URL.Path).Name].ServeHTTP(w, r)
+	})
+}
+
+// sameOrigin reports whether the request came from a page of the broker itself or from an origin
+// allowed for its route group
+func (c *corsConfig) sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		// browsers always send Origin on cross site POSTs, without one this is no browser
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return c.policyFor(r.URL.Path).allows(origin)
+}
+
+// describe lists the effective policy per group, for the startup log
+func (c *corsConfig) describe() string {
+	var parts []string
+	for _, policy := range c.Policies {
+		parts = append(parts, policy.Name+"=["+strings.Join(policy.Origins, " ")+"] credentials="+strconv.FormatBool(policy.AllowCredentials))
+	}
+	return c.Profile + ": " + strings.Join(parts, "; ")
+}
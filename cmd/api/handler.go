@@ -8,14 +8,17 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 )
 
 type SignupPayload struct {
-	FirstName string `json:"first_name"`
-	LastName  string `json:"last_name"`
-	Email     string `json:"email"`
-	Phone     string `json:"phone"`
-	Password  string `json:"password"`
+	FirstName string `json:"first_name" validate:"required,min=2,max=64"`
+	LastName  string `json:"last_name" validate:"required,min=2,max=64"`
+	Email     string `json:"email" validate:"required,email,max=254"`
+	Phone     string `json:"phone" validate:"required,max=32"`
+	Country   string `json:"country,omitempty" validate:"regex=^[A-Za-z]{2}$"`
+	Password  string `json:"password" validate:"required"`
 }
 
 type LoginPayload struct {
@@ -23,9 +26,109 @@ type LoginPayload struct {
 	Password string `json:"password" validate:"required"`
 }
 
-func (app *Config) GetMe()       {}
-func (app *Config) VerifyToken() {}
-func (app *Config) Logout()      {}
+// profile is what GetMe and VerifyToken return about the principal
+type profile struct {
+	UserID      string     `json:"user_id"`
+	Email       string     `json:"email"`
+	Roles       []string   `json:"roles"`
+	Scopes      []string   `json:"scopes,omitempty"`
+	Permissions []string   `json:"permissions"`
+	APIKeyID    string     `json:"api_key_id,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+}
+
+func (app *Config) profile(principal *Principal) profile {
+	p := profile{
+		UserID:   principal.UserID,
+		Email:    principal.Email,
+		Roles:    app.Policy.roles(principal),
+		Scopes:   principal.Scopes,
+		APIKeyID: principal.APIKeyID,
+	}
+
+	seen := map[string]bool{}
+	for _, role := range p.Roles {
+		for _, permission := range rolePermissions[strings.ToLower(role)] {
+			if !seen[permission] && (permission == "*" || app.Policy.can(principal, permission)) {
+				seen[permission] = true
+				p.Permissions = append(p.Permissions, permission)
+			}
+		}
+	}
+
+	if principal.Token != "" {
+		expiresAt := tokenExpiry(principal.Token).UTC()
+		p.ExpiresAt = &expiresAt
+	}
+	return p
+}
+
+func (app *Config) GetMe(w http.ResponseWriter, r *http.Request) {
+	principal, ok := principalFrom(r.Context())
+	if !ok {
+		app.errorJSON(w, errors.New("unauthorized"), nil, http.StatusUnauthorized)
+		return
+	}
+
+	var payload jsonResponse
+	payload.Error = false
+	payload.StatusCode = http.StatusOK
+	payload.Message = "authenticated user"
+	payload.Data = app.profile(principal)
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+func (app *Config) VerifyToken(w http.ResponseWriter, r *http.Request) {
+	//the authenticate middleware already rejected invalid and revoked tokens
+	principal, ok := principalFrom(r.Context())
+	if !ok {
+		app.errorJSON(w, errors.New("unauthorized"), nil, http.StatusUnauthorized)
+		return
+	}
+
+	var payload jsonResponse
+	payload.Error = false
+	payload.StatusCode = http.StatusOK
+	payload.Message = "token is valid"
+	payload.Data = map[string]any{"valid": true, "principal": app.profile(principal)}
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+func (app *Config) Logout(w http.ResponseWriter, r *http.Request) {
+	principal, ok := principalFrom(r.Context())
+	if !ok {
+		app.errorJSON(w, errors.New("unauthorized"), nil, http.StatusUnauthorized)
+		return
+	}
+	if principal.APIKeyID != "" {
+		app.errorJSON(w, errors.New("api keys are revoked through /api/v1/api-keys"), nil)
+		return
+	}
+
+	err := app.revokeToken(principal.Token, principal.UserID)
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+
+	//a broker issued token also ends its session, so the refresh token dies with it
+	if sessionID := app.sessionID(principal); sessionID != "" {
+		err = app.revokeSession(sessionID, "logged out")
+		if err != nil && !errors.Is(err, errSessionNotFound) {
+			app.errorJSON(w, err, nil, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var payload jsonResponse
+	payload.Error = false
+	payload.StatusCode = http.StatusOK
+	payload.Message = "logged out"
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
 
 func (app *Config) Signup(w http.ResponseWriter, r *http.Request) {
 
@@ -40,10 +143,17 @@ func (app *Config) Signup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Validate the request payload
-	if err := app.ValidataSignupInput(requestPayload); len(err) > 0 {
-		log.Println(err)
-		app.errorJSON(w, errors.New("error trying to sign-up user"), err, http.StatusBadRequest)
+	//canonicalize the email and put the phone in E.164 before the auth service stores them
+	err = normalizeSignupContact(&requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, nil)
+		return
+	}
+
+	//the password policy also keeps the name, email and phone out of the password
+	err = app.checkSignupPassword(requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, nil)
 		return
 	}
 
@@ -88,10 +198,18 @@ func (app *Config) Signup(w http.ResponseWriter, r *http.Request) {
 	log.Println("response from auth service", jsonFromService)
 	if response.StatusCode != http.StatusAccepted {
 		log.Println(jsonFromService.Message, jsonFromService)
+		app.audit(r, auditEvent{Type: auditSignup, Email: requestPayload.Email, Status: response.StatusCode, Outcome: outcomeFailure,
+			Detail: map[string]string{"reason": jsonFromService.Message}})
 		app.errorJSON(w, errors.New(jsonFromService.Message), nil)
 		return
 	}
 
+	event := auditEvent{Type: auditSignup, Email: requestPayload.Email, Status: http.StatusOK, Outcome: outcomeSuccess}
+	if principal, err := principalFromData(jsonFromService.Data); err == nil {
+		event.Actor = principal.UserID
+	}
+	app.audit(r, event)
+
 	var payload jsonResponse
 	payload.Error = jsonFromService.Error
 	payload.StatusCode = http.StatusOK
@@ -112,16 +230,66 @@ func (app *Config) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	//refuse locked accounts and slow down repeated failures before bothering the auth service
+	email, ip := normalizeLoginEmail(requestPayload.Email), clientIP(r)
+	if !app.guardLogin(w, r, email) {
+		return
+	}
+
+	//signups store the canonical email, so that is what the auth service gets. Accounts from before
+	//signups were canonicalized may be stored as typed, those are tried as typed when the canonical
+	//email is turned down
+	typed := requestPayload.Email
+	requestPayload.Email = email
+	status, jsonFromService, err := app.authLogin(requestPayload)
+	if err == nil && typed != email && credentialsRejected(status, jsonFromService) {
+		requestPayload.Email = typed
+		status, jsonFromService, err = app.authLogin(requestPayload)
+	}
+	if err != nil {
+		app.errorJSON(w, err, nil)
+		return
+	}
+
+	//count rejected credentials towards the lockout of the email and the ip, an auth service that is
+	//failing must not lock out everyone trying to log in meanwhile
+	if status != http.StatusAccepted || jsonFromService.Error {
+		if credentialsRejected(status, jsonFromService) {
+			if err := app.recordLoginFailure(email, ip); err != nil {
+				log.Println("error recording failed login", err)
+			}
+		}
+		app.audit(r, auditEvent{Type: auditLogin, Email: email, Status: status, Outcome: outcomeFailure,
+			Detail: map[string]string{"reason": jsonFromService.Message}})
+	}
+
+	if status != http.StatusAccepted {
+		app.errorJSON(w, errors.New(jsonFromService.Message), nil)
+		return
+	}
+
+	if jsonFromService.Error {
+		app.errorJSON(w, err, nil, http.StatusUnauthorized)
+		return
+	}
+
+	//accounts with two-factor authentication get a challenge instead of their tokens
+	if app.TwoFactor != nil && app.challengeLogin(w, r, email, jsonFromService.Data) {
+		return
+	}
+
+	app.completeLogin(w, r, email, jsonFromService.Message, jsonFromService.Data)
+}
+
+// authLogin sends the credentials to the login endpoint of the auth service, returning its status and answer
+func (app *Config) authLogin(requestPayload LoginPayload) (int, jsonResponse, error) {
 	//create some json we will send to authservice
 	jsonData, _ := json.MarshalIndent(requestPayload, "", "\t")
 
-	//call the service
 	// call the service by creating a request
 	request, err := http.NewRequest("POST", os.Getenv("AUTH_URL")+"login", bytes.NewBuffer(jsonData))
-
 	if err != nil {
-		app.errorJSON(w, err, nil)
-		return
+		return 0, jsonResponse{}, err
 	}
 
 	// Set the Content-Type header
@@ -129,54 +297,64 @@ func (app *Config) Login(w http.ResponseWriter, r *http.Request) {
 	//create a http client
 	client := &http.Client{}
 	response, err := client.Do(request)
-
 	if err != nil {
-		app.errorJSON(w, err, nil)
-		return
+		return 0, jsonResponse{}, err
 	}
 	defer response.Body.Close()
 
-	// create a variable that 'll read response.Body into
-	var jsonFromService jsonResponse
-
 	// decode the json from the auth service
+	var jsonFromService jsonResponse
 	err = json.NewDecoder(response.Body).Decode(&jsonFromService)
 	if err != nil {
-		app.errorJSON(w, err, nil)
-		return
+		return 0, jsonResponse{}, err
 	}
+	return response.StatusCode, jsonFromService, nil
+}
 
-	//check the status of the response
-	if response.StatusCode != http.StatusAccepted {
-		app.errorJSON(w, errors.New(jsonFromService.Message), nil)
-		return
+// completeLogin clears the failed logins of the email and hands out what the auth service returned,
+// once every factor checked out
+func (app *Config) completeLogin(w http.ResponseWriter, r *http.Request, email, message string, data any) {
+	if err := app.recordLoginSuccess(email); err != nil {
+		log.Println("error clearing failed logins", err)
 	}
 
-	if jsonFromService.Error {
-		app.errorJSON(w, err, nil, http.StatusUnauthorized)
-		return
+	event := auditEvent{Type: auditLogin, Email: email, Status: http.StatusOK, Outcome: outcomeSuccess}
+	if principal, err := principalFromData(data); err == nil {
+		event.Actor = principal.UserID
+		//wallet logins get the roles the account has now
+		if err := app.syncWalletRoles(principal); err != nil {
+			log.Println("error updating the roles of linked wallets", err)
+		}
 	}
+	app.audit(r, event)
 
 	var payload jsonResponse
-	payload.Error = jsonFromService.Error
+	payload.Error = false
 	payload.StatusCode = http.StatusOK
-	payload.Message = jsonFromService.Message
-	payload.Data = jsonFromService.Data
+	payload.Message = message
+	payload.Data = data
+
+	//hand out the broker's own short lived access token and a refresh token on top
+	if app.Tokens != nil {
+		principal, err := principalFromData(data)
+		if err != nil {
+			app.errorJSON(w, err, nil, http.StatusBadGateway)
+			return
+		}
+
+		tokens, err := app.startSession(w, r, principal)
+		if err != nil {
+			app.errorJSON(w, err, nil, http.StatusInternalServerError)
+			return
+		}
+		payload.Data = withTokens(data, tokens)
+	}
 
 	app.writeJSON(w, http.StatusOK, payload)
 }
 
 func (app *Config) GetAllUsers(w http.ResponseWriter, r *http.Request) {
 
-	result, err := app.getUserToken(w, r)
-	if err != nil {
-		app.errorJSON(w, errors.New(result.Message), nil)
-		return
-	}
-	if result.Error {
-		app.errorJSON(w, errors.New(result.Message), result.Data)
-		return
-	}
 	// call the service by creating a request
 	request, err := http.NewRequest("GET", os.Getenv("AUTH_URL")+"all-users", nil)
 
@@ -187,6 +365,7 @@ func (app *Config) GetAllUsers(w http.ResponseWriter, r *http.Request) {
 
 	// Set the Content-Type header
 	request.Header.Set("Content-Type", "application/json")
+	forwardPrincipal(r.Context(), request)
 	//create a http client
 	client := &http.Client{}
 	response, err := client.Do(request)
@@ -228,31 +407,10 @@ func (app *Config) GetAllUsers(w http.ResponseWriter, r *http.Request) {
 }
 func (app *Config) MainnetMissedCheckpoint(w http.ResponseWriter, r *http.Request) {
 
-	result, err := app.getUserToken(w, r)
-	if err != nil {
-		app.errorJSON(w, errors.New(result.Message), nil)
-		return
-	}
-	if result.Error {
-		app.errorJSON(w, errors.New(result.Message), result.Data)
-		return
-	}
-	// call the service by creating a request
-	request, err := http.NewRequest("GET", os.Getenv("SERVICE_URL")+"pos/mainnet/mainnet-missed-checkpoint", nil)
-
-	if err != nil {
-		app.errorJSON(w, err, nil)
-		return
-	}
-
-	// Set the Content-Type header
-	request.Header.Set("Content-Type", "application/json")
-	//create a http client
-	client := &http.Client{}
-	response, err := client.Do(request)
-
+	// call the service through the upstream pool of the network
+	response, err := app.Upstreams["mainnet"].get(r.Context(), "pos/mainnet/mainnet-missed-checkpoint")
 	if err != nil {
-		app.errorJSON(w, err, nil)
+		app.errorJSON(w, err, nil, http.StatusBadGateway)
 		return
 	}
 	defer response.Body.Close()
@@ -288,31 +446,10 @@ func (app *Config) MainnetMissedCheckpoint(w http.ResponseWriter, r *http.Reques
 }
 func (app *Config) TestnetMissedCheckpoint(w http.ResponseWriter, r *http.Request) {
 
-	result, err := app.getUserToken(w, r)
+	// call the service through the upstream pool of the network
+	response, err := app.Upstreams["testnet"].get(r.Context(), "pos/testnet/testnet-missed-checkpoint")
 	if err != nil {
-		app.errorJSON(w, errors.New(result.Message), nil)
-		return
-	}
-	if result.Error {
-		app.errorJSON(w, errors.New(result.Message), result.Data)
-		return
-	}
-	// call the service by creating a request
-	request, err := http.NewRequest("GET", os.Getenv("SERVICE_URL")+"pos/testnet/testnet-missed-checkpoint", nil)
-
-	if err != nil {
-		app.errorJSON(w, err, nil)
-		return
-	}
-
-	// Set the Content-Type header
-	request.Header.Set("Content-Type", "application/json")
-	//create a http client
-	client := &http.Client{}
-	response, err := client.Do(request)
-
-	if err != nil {
-		app.errorJSON(w, err, nil)
+		app.errorJSON(w, err, nil, http.StatusBadGateway)
 		return
 	}
 	defer response.Body.Close()
@@ -348,31 +485,10 @@ func (app *Config) TestnetMissedCheckpoint(w http.ResponseWriter, r *http.Reques
 }
 func (app *Config) MainnetHeimdalBlockHeight(w http.ResponseWriter, r *http.Request) {
 
-	result, err := app.getUserToken(w, r)
+	// call the service through the upstream pool of the network
+	response, err := app.Upstreams["mainnet"].get(r.Context(), "pos/mainnet/heimdal-block-height")
 	if err != nil {
-		app.errorJSON(w, errors.New(result.Message), nil)
-		return
-	}
-	if result.Error {
-		app.errorJSON(w, errors.New(result.Message), result.Data)
-		return
-	}
-	// call the service by creating a request
-	request, err := http.NewRequest("GET", os.Getenv("SERVICE_URL")+"pos/mainnet/heimdal-block-height", nil)
-
-	if err != nil {
-		app.errorJSON(w, err, nil)
-		return
-	}
-
-	// Set the Content-Type header
-	request.Header.Set("Content-Type", "application/json")
-	//create a http client
-	client := &http.Client{}
-	response, err := client.Do(request)
-
-	if err != nil {
-		app.errorJSON(w, err, nil)
+		app.errorJSON(w, err, nil, http.StatusBadGateway)
 		return
 	}
 	defer response.Body.Close()
@@ -408,31 +524,10 @@ func (app *Config) MainnetHeimdalBlockHeight(w http.ResponseWriter, r *http.Requ
 }
 func (app *Config) TestnetHeimdalBlockHeight(w http.ResponseWriter, r *http.Request) {
 
-	result, err := app.getUserToken(w, r)
-	if err != nil {
-		app.errorJSON(w, errors.New(result.Message), nil)
-		return
-	}
-	if result.Error {
-		app.errorJSON(w, errors.New(result.Message), result.Data)
-		return
-	}
-	// call the service by creating a request
-	request, err := http.NewRequest("GET", os.Getenv("SERVICE_URL")+"pos/testnet/heimdal-block-height", nil)
-
-	if err != nil {
-		app.errorJSON(w, err, nil)
-		return
-	}
-
-	// Set the Content-Type header
-	request.Header.Set("Content-Type", "application/json")
-	//create a http client
-	client := &http.Client{}
-	response, err := client.Do(request)
-
+	// call the service through the upstream pool of the network
+	response, err := app.Upstreams["testnet"].get(r.Context(), "pos/testnet/heimdal-block-height")
 	if err != nil {
-		app.errorJSON(w, err, nil)
+		app.errorJSON(w, err, nil, http.StatusBadGateway)
 		return
 	}
 	defer response.Body.Close()
@@ -468,31 +563,10 @@ func (app *Config) TestnetHeimdalBlockHeight(w http.ResponseWriter, r *http.Requ
 }
 func (app *Config) MainnetBorLatestBlockDetails(w http.ResponseWriter, r *http.Request) {
 
-	result, err := app.getUserToken(w, r)
-	if err != nil {
-		app.errorJSON(w, errors.New(result.Message), nil)
-		return
-	}
-	if result.Error {
-		app.errorJSON(w, errors.New(result.Message), result.Data)
-		return
-	}
-	// call the service by creating a request
-	request, err := http.NewRequest("GET", os.Getenv("SERVICE_URL")+"pos/testnet/bor-latest-block-details", nil)
-
-	if err != nil {
-		app.errorJSON(w, err, nil)
-		return
-	}
-
-	// Set the Content-Type header
-	request.Header.Set("Content-Type", "application/json")
-	//create a http client
-	client := &http.Client{}
-	response, err := client.Do(request)
-
+	// call the service through the upstream pool of the network
+	response, err := app.Upstreams["mainnet"].get(r.Context(), "pos/testnet/bor-latest-block-details")
 	if err != nil {
-		app.errorJSON(w, err, nil)
+		app.errorJSON(w, err, nil, http.StatusBadGateway)
 		return
 	}
 	defer response.Body.Close()
@@ -528,31 +602,10 @@ func (app *Config) MainnetBorLatestBlockDetails(w http.ResponseWriter, r *http.R
 }
 func (app *Config) TestnetBorLatestBlockDetails(w http.ResponseWriter, r *http.Request) {
 
-	result, err := app.getUserToken(w, r)
+	// call the service through the upstream pool of the network
+	response, err := app.Upstreams["testnet"].get(r.Context(), "pos/testnet/bor-latest-block-details")
 	if err != nil {
-		app.errorJSON(w, errors.New(result.Message), nil)
-		return
-	}
-	if result.Error {
-		app.errorJSON(w, errors.New(result.Message), result.Data)
-		return
-	}
-	// call the service by creating a request
-	request, err := http.NewRequest("GET", os.Getenv("SERVICE_URL")+"pos/testnet/bor-latest-block-details", nil)
-
-	if err != nil {
-		app.errorJSON(w, err, nil)
-		return
-	}
-
-	// Set the Content-Type header
-	request.Header.Set("Content-Type", "application/json")
-	//create a http client
-	client := &http.Client{}
-	response, err := client.Do(request)
-
-	if err != nil {
-		app.errorJSON(w, err, nil)
+		app.errorJSON(w, err, nil, http.StatusBadGateway)
 		return
 	}
 	defer response.Body.Close()
@@ -588,31 +641,10 @@ func (app *Config) TestnetBorLatestBlockDetails(w http.ResponseWriter, r *http.R
 }
 func (app *Config) MainnetStateSync(w http.ResponseWriter, r *http.Request) {
 
-	result, err := app.getUserToken(w, r)
+	// call the service through the upstream pool of the network
+	response, err := app.Upstreams["mainnet"].get(r.Context(), "pos/mainnet/state-sync")
 	if err != nil {
-		app.errorJSON(w, errors.New(result.Message), nil)
-		return
-	}
-	if result.Error {
-		app.errorJSON(w, errors.New(result.Message), result.Data)
-		return
-	}
-	// call the service by creating a request
-	request, err := http.NewRequest("GET", os.Getenv("SERVICE_URL")+"pos/mainnet/state-sync", nil)
-
-	if err != nil {
-		app.errorJSON(w, err, nil)
-		return
-	}
-
-	// Set the Content-Type header
-	request.Header.Set("Content-Type", "application/json")
-	//create a http client
-	client := &http.Client{}
-	response, err := client.Do(request)
-
-	if err != nil {
-		app.errorJSON(w, err, nil)
+		app.errorJSON(w, err, nil, http.StatusBadGateway)
 		return
 	}
 	defer response.Body.Close()
@@ -648,31 +680,10 @@ func (app *Config) MainnetStateSync(w http.ResponseWriter, r *http.Request) {
 }
 func (app *Config) TestnetStateSync(w http.ResponseWriter, r *http.Request) {
 
-	result, err := app.getUserToken(w, r)
-	if err != nil {
-		app.errorJSON(w, errors.New(result.Message), nil)
-		return
-	}
-	if result.Error {
-		app.errorJSON(w, errors.New(result.Message), result.Data)
-		return
-	}
-	// call the service by creating a request
-	request, err := http.NewRequest("GET", os.Getenv("SERVICE_URL")+"pos/testnet/state-sync", nil)
-
-	if err != nil {
-		app.errorJSON(w, err, nil)
-		return
-	}
-
-	// Set the Content-Type header
-	request.Header.Set("Content-Type", "application/json")
-	//create a http client
-	client := &http.Client{}
-	response, err := client.Do(request)
-
+	// call the service through the upstream pool of the network
+	response, err := app.Upstreams["testnet"].get(r.Context(), "pos/testnet/state-sync")
 	if err != nil {
-		app.errorJSON(w, err, nil)
+		app.errorJSON(w, err, nil, http.StatusBadGateway)
 		return
 	}
 	defer response.Body.Close()
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// allowedMethods is every method a route of the broker is registered for, anything else is refused
+// before it reaches the router
+var allowedMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodOptions}
+
+// the broker only serves json, so its pages may load nothing and be framed by no one
+const contentSecurityPolicy = "default-src 'none'; frame-ancestors 'none'; base-uri 'none'; form-action 'none'"
+
+// securityHeaders sets the hardening headers on every response. HSTS is sent in production only, for
+// HSTS_MAX_AGE (two years by default, 0 turns it off)
+func (app *Config) securityHeaders(next http.Handler) http.Handler {
+	hsts := ""
+	if app.CORS.Profile == "production" {
+		if maxAge := envDuration("HSTS_MAX_AGE", 2*365*24*time.Hour); maxAge > 0 {
+			hsts = fmt.Sprintf("max-age=%d; includeSubDomains", int(maxAge.Seconds()))
+		}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header()
+		if hsts != "" {
+			header.Set("Strict-Transport-Security", hsts)
+		}
+		header.Set("X-Content-Type-Options", "nosniff")
+		header.Set("X-Frame-Options", "DENY")
+		header.Set("Referrer-Policy", "no-referrer")
+		header.Set("Content-Security-Policy", contentSecurityPolicy)
+		header.Set("Cross-Origin-Opener-Policy", "same-origin")
+		header.Set("Cross-Origin-Resource-Policy", "same-site")
+		header.Set("Permissions-Policy", "camera=(), microphone=(), geolocation=(), payment=()")
+		header.Set("Cache-Control", "no-store")
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rejectUnexpectedMethods refuses TRACE, CONNECT and any made up method with a 405
+func (app *Config) rejectUnexpectedMethods(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, method := range allowedMethods {
+			if r.Method == method {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		w.Header().Set("Allow", strings.Join(allowedMethods, ", "))
+		app.errorJSON(w, newCodedError("http.method_not_allowed", "method", r.Method), nil, http.StatusMethodNotAllowed)
+	})
+}
+
+// methodNotAllowed answers a known path requested with a method it isn't registered for
+func (app *Config) methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	app.errorJSON(w, newCodedError("http.method_not_allowed_on", "method", r.Method, "path", r.URL.Path), nil, http.StatusMethodNotAllowed)
+}
+
+func (app *Config) notFound(w http.ResponseWriter, r *http.Request) {
+	app.errorJSON(w, newCodedError("http.not_found", "path", r.URL.Path), nil, http.StatusNotFound)
+}
+
+// newServer returns the http server with limits that keep slow or oversized requests from tying up
+// connections, every limit can be tuned from the environment
+func (app *Config) newServer(addr string) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           app.routes(),
+		ReadHeaderTimeout: envDuration("SERVER_READ_HEADER_TIMEOUT", 5*time.Second),
+		ReadTimeout:       envDuration("SERVER_READ_TIMEOUT", 30*time.Second),
+		// checkpoint proofs fetch whole block ranges from bor, so writes get more room than reads
+		WriteTimeout:   envDuration("SERVER_WRITE_TIMEOUT", 2*time.Minute),
+		IdleTimeout:    envDuration("SERVER_IDLE_TIMEOUT", 2*time.Minute),
+		MaxHeaderBytes: envInt("SERVER_MAX_HEADER_BYTES", 16<<10),
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// errBlockNotCheckpointed is returned when a block is newer than the last submitted checkpoint
+var errBlockNotCheckpointed = errors.New("block is not yet included in a checkpoint")
+
+// flexUint decodes heimdall numbers, which are sent either as json numbers or quoted strings
+type flexUint uint64
+
+func (n *flexUint) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	if s == "" || s == "null" {
+		*n = 0
+		return nil
+	}
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return err
+	}
+	*n = flexUint(v)
+	return nil
+}
+
+type heimdallCheckpoint struct {
+	ID         uint64   `json:"id"`
+	Proposer   string   `json:"proposer"`
+	StartBlock flexUint `json:"start_block"`
+	EndBlock   flexUint `json:"end_block"`
+	RootHash   string   `json:"root_hash"`
+	BorChainID string   `json:"bor_chain_id"`
+	Timestamp  flexUint `json:"timestamp"`
+}
+
+// checkpointCache keeps checkpoints already fetched from heimdall, they never change once acknowledged
+type checkpointCache struct {
+	mu          sync.RWMutex
+	checkpoints map[string]map[uint64]heimdallCheckpoint
+}
+
+var checkpoints = &checkpointCache{checkpoints: map[string]map[uint64]heimdallCheckpoint{}}
+
+func (c *checkpointCache) get(network string, id uint64) (heimdallCheckpoint, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	cp, ok := c.checkpoints[network][id]
+	return cp, ok
+}
+
+func (c *checkpointCache) put(network string, cp heimdallCheckpoint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.checkpoints[network] == nil {
+		c.checkpoints[network] = map[uint64]heimdallCheckpoint{}
+	}
+	c.checkpoints[network][cp.ID] = cp
+}
+
+// heimdallGet calls the heimdall rest api and decodes the "result" field of the response
+func heimdallGet(ctx context.Context, network *posNetwork, path string, result any) error {
+	request, err := http.NewRequestWithContext(ctx, "GET", network.HeimdallURL+path, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := chainClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("heimdall %s returned status %d", path, response.StatusCode)
+	}
+
+	var jsonFromHeimdall struct {
+		Result json.RawMessage `json:"result"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&jsonFromHeimdall)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(jsonFromHeimdall.Result, result)
+}
+
+// checkpointCount returns the number of checkpoints acknowledged on heimdall
+func checkpointCount(ctx context.Context, network *posNetwork) (uint64, error) {
+	var count struct {
+		Result flexUint `json:"result"`
+	}
+	err := heimdallGet(ctx, network, "checkpoints/count", &count)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(count.Result), nil
+}
+
+// checkpointByID fetches a single checkpoint, serving it from the cache when possible
+func checkpointByID(ctx context.Context, network *posNetwork, id uint64) (heimdallCheckpoint, error) {
+	if cp, ok := checkpoints.get(network.Name, id); ok {
+		return cp, nil
+	}
+
+	var cp heimdallCheckpoint
+	err := heimdallGet(ctx, network, fmt.Sprintf("checkpoints/%d", id), &cp)
+	if err != nil {
+		return heimdallCheckpoint{}, err
+	}
+	cp.ID = id
+
+	checkpoints.put(network.Name, cp)
+	return cp, nil
+}
+
+// findCheckpoint binary searches the acknowledged checkpoints for the one covering block
+func findCheckpoint(ctx context.Context, network *posNetwork, block uint64) (heimdallCheckpoint, uint64, error) {
+	count, err := checkpointCount(ctx, network)
+	if err != nil {
+		return heimdallCheckpoint{}, 0, err
+	}
+	if count == 0 {
+		return heimdallCheckpoint{}, 0, errBlockNotCheckpointed
+	}
+
+	latest, err := checkpointByID(ctx, network, count)
+	if err != nil {
+		return heimdallCheckpoint{}, 0, err
+	}
+	lastCheckpointed := uint64(latest.EndBlock)
+	if block > lastCheckpointed {
+		return heimdallCheckpoint{}, lastCheckpointed, errBlockNotCheckpointed
+	}
+
+	low, high := uint64(1), count
+	for low <= high {
+		mid := low + (high-low)/2
+		cp, err := checkpointByID(ctx, network, mid)
+		if err != nil {
+			return heimdallCheckpoint{}, lastCheckpointed, err
+		}
+
+		switch {
+		case block < uint64(cp.StartBlock):
+			high = mid - 1
+		case block > uint64(cp.EndBlock):
+			low = mid + 1
+		default:
+			return cp, lastCheckpointed, nil
+		}
+	}
+
+	return heimdallCheckpoint{}, lastCheckpointed, fmt.Errorf("no checkpoint found covering block %d", block)
+}
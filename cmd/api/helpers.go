@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"io"
@@ -11,6 +13,7 @@ import (
 
 type jsonResponse struct {
 	Error      bool   `json:"error"`
+	Code       string `json:"code,omitempty"`
 	Message    string `json:"message"`
 	StatusCode int    `json:"status_code"`
 	Data       any    `json:"data,omitempty"`
@@ -35,7 +38,8 @@ func (app *Config) readJSON(w http.ResponseWriter, r *http.Request, data any) er
 		return errors.New("body must have only a single json value")
 	}
 
-	return nil
+	//apply the validate tags of the payload
+	return validate(data)
 }
 
 // write json
@@ -73,12 +77,33 @@ func (app *Config) errorJSON(w http.ResponseWriter, err error, data any, status
 		statusCode = status[0]
 	}
 
+	lang := responseLanguage(w)
+
 	var payload jsonResponse
 	payload.Error = true
+	payload.Code = statusErrorCode(statusCode)
 	payload.Message = err.Error()
 	payload.StatusCode = statusCode
 	payload.Data = data
 
+	//errors with a code of their own are sent in the language of the client
+	var coded *codedError
+	if errors.As(err, &coded) {
+		payload.Code = coded.Code
+		payload.Message = localize(lang, coded.Code, coded.Params)
+	}
+
+	//field errors are the data of a failed validation unless the caller passed its own
+	var invalid *validationError
+	if errors.As(err, &invalid) {
+		invalid.localize(lang)
+		payload.Code = validationFailed
+		payload.Message = invalid.message(lang)
+		if data == nil {
+			payload.Data = invalid.Fields
+		}
+	}
+
 	return app.writeJSON(w, statusCode, payload)
 }
 
@@ -134,3 +159,13 @@ func (app *Config) getToken(r *http.Request) (jsonResponse, error) {
 
 	return payload, nil
 }
+
+// randomString returns n random bytes, hex encoded
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
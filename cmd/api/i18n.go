@@ -0,0 +1,156 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"golang.org/x/text/language"
+)
+
+// every message a client can see has a stable code, locales/<language>.json maps the codes to the
+// message in that language with {name} placeholders for the params. English is the fallback for
+// languages and codes the catalogs don't have
+//
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+const defaultLanguage = "en"
+
+var catalogs, supportedLanguages = loadCatalogs()
+
+var languageMatcher = newLanguageMatcher()
+
+// codedError is an error the client gets as a catalog message in its own language
+type codedError struct {
+	Code   string
+	Params map[string]string
+}
+
+// newCodedError takes the params as name, value pairs
+func newCodedError(code string, params ...string) *codedError {
+	return &codedError{Code: code, Params: messageParams(params)}
+}
+
+func (e *codedError) Error() string {
+	return localize(defaultLanguage, e.Code, e.Params)
+}
+
+// localizable is implemented by error data holding messages of its own, errorJSON translates them
+// along with the message of the response
+type localizable interface {
+	localize(lang string)
+}
+
+func loadCatalogs() (map[string]map[string]string, []string) {
+	files, err := localeFiles.ReadDir("locales")
+	if err != nil {
+		log.Panic(err)
+	}
+
+	catalogs := map[string]map[string]string{}
+	languages := []string{defaultLanguage}
+	for _, file := range files {
+		data, err := localeFiles.ReadFile("locales/" + file.Name())
+		if err != nil {
+			log.Panic(err)
+		}
+		catalog := map[string]string{}
+		if err := json.Unmarshal(data, &catalog); err != nil {
+			log.Panicf("locales/%s: %v", file.Name(), err)
+		}
+
+		lang := strings.TrimSuffix(file.Name(), path.Ext(file.Name()))
+		catalogs[lang] = catalog
+		if lang != defaultLanguage {
+			languages = append(languages, lang)
+		}
+	}
+
+	if _, ok := catalogs[defaultLanguage]; !ok {
+		log.Panicf("locales/%s.json is missing", defaultLanguage)
+	}
+	return catalogs, languages
+}
+
+// newLanguageMatcher matches against the catalogs, the first tag is what clients get when nothing matches
+func newLanguageMatcher() language.Matcher {
+	tags := make([]language.Tag, len(supportedLanguages))
+	for i, lang := range supportedLanguages {
+		tags[i] = language.MustParse(lang)
+	}
+	return language.NewMatcher(tags)
+}
+
+func messageParams(pairs []string) map[string]string {
+	params := make(map[string]string, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		params[pairs[i]] = pairs[i+1]
+	}
+	return params
+}
+
+// localize returns the message of code in lang with its params filled in, or the code itself when no
+// catalog knows it
+func localize(lang, code string, params map[string]string) string {
+	message, ok := catalogs[lang][code]
+	if !ok {
+		message, ok = catalogs[defaultLanguage][code]
+	}
+	if !ok {
+		return code
+	}
+
+	if len(params) > 0 {
+		replacements := make([]string, 0, len(params)*2)
+		for name, value := range params {
+			replacements = append(replacements, "{"+name+"}", value)
+		}
+		message = strings.NewReplacer(replacements...).Replace(message)
+	}
+	return message
+}
+
+// preferredLanguage picks the catalog that best fits an Accept-Language header, fr-CA gets fr
+func preferredLanguage(accept string) string {
+	tags, _, err := language.ParseAcceptLanguage(accept)
+	if err != nil || len(tags) == 0 {
+		return defaultLanguage
+	}
+	_, index, confidence := languageMatcher.Match(tags...)
+	if confidence == language.No {
+		return defaultLanguage
+	}
+	return supportedLanguages[index]
+}
+
+// responseLanguage is the language negotiateLanguage chose for the response
+func responseLanguage(w http.ResponseWriter) string {
+	if lang := w.Header().Get("Content-Language"); catalogs[lang] != nil {
+		return lang
+	}
+	return defaultLanguage
+}
+
+// statusErrorCode is the code of errors that have none of their own, e.g. not_found
+func statusErrorCode(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return "error"
+	}
+	return strings.ToLower(strings.NewReplacer(" ", "_", "-", "_", "'", "").Replace(text))
+}
+
+// negotiateLanguage announces the language of the messages in the Content-Language of the response,
+// where errorJSON picks it up without needing the request
+func (app *Config) negotiateLanguage(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Language", preferredLanguage(r.Header.Get("Accept-Language")))
+		w.Header().Add("Vary", "Accept-Language")
+
+		next.ServeHTTP(w, r)
+	})
+}
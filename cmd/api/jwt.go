@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// unknown key ids trigger a jwks refresh, but never more often than this
+const jwksMinRefresh = 30 * time.Second
+
+// tokenVerifier checks bearer tokens locally instead of asking the auth service on every request
+type tokenVerifier struct {
+	Secret         []byte
+	JWKS           *jwksCache
+	Issuer         string
+	Audience       string
+	RemoteFallback bool
+	Leeway         time.Duration
+}
+
+// jwksCache holds the public keys published by the auth service, keyed by kid. One refresh runs at a
+// time and the lock is never held while it downloads, so the cached keys keep verifying meanwhile
+type jwksCache struct {
+	URL        string
+	MaxAge     time.Duration
+	mu         sync.RWMutex
+	keys       map[string]any
+	fetched    time.Time
+	refreshing chan struct{}
+	err        error
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// loadTokenVerifier configures local verification from the environment, it returns nil when
+// neither JWT_SECRET nor JWT_JWKS_URL is set and every token is verified by the auth service
+func loadTokenVerifier() *tokenVerifier {
+	verifier := &tokenVerifier{
+		Issuer:         os.Getenv("JWT_ISSUER"),
+		Audience:       os.Getenv("JWT_AUDIENCE"),
+		RemoteFallback: os.Getenv("JWT_REMOTE_FALLBACK") == "true",
+		Leeway:         envDuration("JWT_LEEWAY", 30*time.Second),
+	}
+
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		verifier.Secret = []byte(secret)
+	}
+	if jwksURL := os.Getenv("JWT_JWKS_URL"); jwksURL != "" {
+		verifier.JWKS = &jwksCache{URL: jwksURL, MaxAge: envDuration("JWT_JWKS_MAX_AGE", 10*time.Minute)}
+	}
+
+	if verifier.Secret == nil && verifier.JWKS == nil {
+		return nil
+	}
+	return verifier
+}
+
+// verify checks the signature and the exp, nbf, iss and aud claims of token
+func (v *tokenVerifier) verify(token string) (jwt.MapClaims, error) {
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods(v.methods()),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(v.Leeway),
+	}
+	if v.Issuer != "" {
+		options = append(options, jwt.WithIssuer(v.Issuer))
+	}
+	if v.Audience != "" {
+		options = append(options, jwt.WithAudience(v.Audience))
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, v.key, options...)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (v *tokenVerifier) methods() []string {
+	var methods []string
+	if v.Secret != nil {
+		methods = append(methods, "HS256")
+	}
+	if v.JWKS != nil {
+		methods = append(methods, "RS256", "ES256")
+	}
+	return methods
+}
+
+// key resolves the verification key for the algorithm and kid in the token header
+func (v *tokenVerifier) key(token *jwt.Token) (any, error) {
+	switch token.Method.(type) {
+	case *jwt.SigningMethodHMAC:
+		return v.Secret, nil
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+		kid, _ := token.Header["kid"].(string)
+		return v.JWKS.key(kid)
+	}
+	return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+}
+
+func (c *jwksCache) key(kid string) (any, error) {
+	c.mu.RLock()
+	key, ok := c.keys[kid]
+	age := time.Since(c.fetched)
+	c.mu.RUnlock()
+
+	switch {
+	case ok && age <= c.MaxAge:
+		return key, nil
+	case ok:
+		// a stale key keeps working while the new document is downloaded
+		c.refresh()
+		return key, nil
+	case age > c.MaxAge || age > jwksMinRefresh:
+		// an unknown kid may be a rotated key, wait for the document that may have it
+		<-c.refresh()
+		c.mu.RLock()
+		key, ok = c.keys[kid]
+		err := c.err
+		c.mu.RUnlock()
+		if !ok && err != nil {
+			return nil, err
+		}
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("no signing key found for kid %q", kid)
+	}
+	return key, nil
+}
+
+// refresh starts downloading the jwks document unless that is already under way, and returns a
+// channel that is closed once the download is done
+func (c *jwksCache) refresh() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.refreshing != nil {
+		return c.refreshing
+	}
+
+	done := make(chan struct{})
+	c.refreshing = done
+	go func() {
+		keys, err := c.fetch()
+
+		c.mu.Lock()
+		if err == nil {
+			c.keys = keys
+			c.fetched = time.Now()
+		}
+		c.err = err
+		c.refreshing = nil
+		c.mu.Unlock()
+		close(done)
+	}()
+	return done
+}
+
+// fetch downloads the jwks document and decodes the signing keys in it
+func (c *jwksCache) fetch() (map[string]any, error) {
+	response, err := chainClient.Get(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jwks endpoint returned status %d", response.StatusCode)
+	}
+
+	var document struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&document)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := map[string]any{}
+	for _, jwk := range document.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+func (jwk jsonWebKey) publicKey() (any, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %s", jwk.Kty)
+}
+
+// bearerToken extracts the token from the Authorization header
+func bearerToken(r *http.Request) (string, error) {
+	authorizationHeader := r.Header.Get("Authorization")
+	scheme, token, ok := strings.Cut(authorizationHeader, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", errors.New("authorization header must be a bearer token")
+	}
+	return strings.TrimSpace(token), nil
+}
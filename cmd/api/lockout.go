@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const loginAttemptsBucket = "login_attempts"
+
+// only the most recent security events are kept in memory
+const maxSecurityEvents = 500
+
+// loginAttempts counts the failed logins of one email or one ip within the current window
+type loginAttempts struct {
+	Key           string     `json:"key"`
+	Failures      int        `json:"failures"`
+	WindowStart   time.Time  `json:"window_start"`
+	LastFailureAt time.Time  `json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until,omitempty"`
+	Lockouts      int        `json:"lockouts"`
+	Emails        []string   `json:"emails,omitempty"`
+}
+
+func (a loginAttempts) locked(now time.Time) bool {
+	return a.LockedUntil != nil && now.Before(*a.LockedUntil)
+}
+
+// loginGuard holds the brute force settings that come from the environment
+type loginGuard struct {
+	MaxFailures       int
+	IPMaxFailures     int
+	Window            time.Duration
+	LockDuration      time.Duration
+	MaxLockDuration   time.Duration
+	DelayBase         time.Duration
+	DelayMax          time.Duration
+	StuffingThreshold int
+
+	mu     sync.Mutex
+	events []securityEvent
+}
+
+// securityEvent is something suspicious an admin may want to look at
+type securityEvent struct {
+	Type   string         `json:"type"`
+	At     time.Time      `json:"at"`
+	IP     string         `json:"ip,omitempty"`
+	Email  string         `json:"email,omitempty"`
+	Detail map[string]any `json:"detail,omitempty"`
+}
+
+func loadLoginGuard() *loginGuard {
+	return &loginGuard{
+		MaxFailures:       envInt("LOGIN_MAX_FAILURES", 5),
+		IPMaxFailures:     envInt("LOGIN_IP_MAX_FAILURES", 20),
+		Window:            envDuration("LOGIN_FAILURE_WINDOW", 15*time.Minute),
+		LockDuration:      envDuration("LOGIN_LOCK_DURATION", 15*time.Minute),
+		MaxLockDuration:   envDuration("LOGIN_MAX_LOCK_DURATION", 24*time.Hour),
+		DelayBase:         envDuration("LOGIN_DELAY_BASE", 500*time.Millisecond),
+		DelayMax:          envDuration("LOGIN_DELAY_MAX", 8*time.Second),
+		StuffingThreshold: envInt("LOGIN_STUFFING_THRESHOLD", 10),
+	}
+}
+
+// normalizeLoginEmail returns the canonical form signups are stored under, or at least a lowercased one
+func normalizeLoginEmail(email string) string {
+	if canonical, err := canonicalEmail(email); err == nil {
+		return canonical
+	}
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// delay grows exponentially with every failure in the window
+func (g *loginGuard) delay(failures int) time.Duration {
+	if failures <= 0 || g.DelayBase <= 0 {
+		return 0
+	}
+	delay := time.Duration(float64(g.DelayBase) * math.Pow(2, float64(failures-1)))
+	if delay > g.DelayMax || delay <= 0 {
+		return g.DelayMax
+	}
+	return delay
+}
+
+// lockFor doubles the lock with every lockout the key already had, up to MaxLockDuration
+func (g *loginGuard) lockFor(lockouts int) time.Duration {
+	lock := time.Duration(float64(g.LockDuration) * math.Pow(2, float64(lockouts)))
+	if lock > g.MaxLockDuration || lock <= 0 {
+		return g.MaxLockDuration
+	}
+	return lock
+}
+
+// record keeps a security event and logs it
+func (g *loginGuard) record(event securityEvent) {
+	event.At = time.Now().UTC()
+	data, _ := json.Marshal(event)
+	log.Println("security event", string(data))
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.events = append(g.events, event)
+	if len(g.events) > maxSecurityEvents {
+		g.events = g.events[len(g.events)-maxSecurityEvents:]
+	}
+}
+
+func (g *loginGuard) recentEvents() []securityEvent {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	events := make([]securityEvent, len(g.events))
+	copy(events, g.events)
+	return events
+}
+
+// checkLogin returns how long the email or ip is still locked for, or how long to hold the attempt
+// back because of earlier failures
+func (app *Config) checkLogin(email, ip string) (locked time.Duration, delay time.Duration, err error) {
+	now := time.Now()
+	for _, key := range []string{"email:" + email, "ip:" + ip} {
+		var attempts loginAttempts
+		found, err := app.Store.get(loginAttemptsBucket, key, &attempts)
+		if err != nil {
+			return 0, 0, err
+		}
+		if !found {
+			continue
+		}
+		if attempts.locked(now) {
+			if wait := attempts.LockedUntil.Sub(now); wait > locked {
+				locked = wait
+			}
+		}
+		if now.Sub(attempts.WindowStart) <= app.Guard.Window {
+			if d := app.Guard.delay(attempts.Failures); d > delay {
+				delay = d
+			}
+		}
+	}
+	return locked, delay, nil
+}
+
+// credentialsRejected tells a login the auth service turned down for its email or password apart from
+// the auth service failing to answer it
+func credentialsRejected(status int, response jsonResponse) bool {
+	switch status {
+	case http.StatusUnauthorized:
+		return true
+	case http.StatusBadRequest, http.StatusAccepted:
+		return response.Error
+	}
+	return false
+}
+
+// recordLoginFailure counts a rejected login against both the email and the ip, locking either
+// once it crosses its threshold
+func (app *Config) recordLoginFailure(email, ip string) error {
+	g := app.Guard
+	now := time.Now().UTC()
+
+	var byEmail loginAttempts
+	err := app.Store.modify(loginAttemptsBucket, "email:"+email, &byEmail, func(bool) error {
+		byEmail.Key = "email:" + email
+		if now.Sub(byEmail.WindowStart) > g.Window {
+			byEmail.Failures, byEmail.WindowStart = 0, now
+		}
+		byEmail.Failures++
+		byEmail.LastFailureAt = now
+
+		if byEmail.Failures >= g.MaxFailures {
+			until := now.Add(g.lockFor(byEmail.Lockouts))
+			byEmail.LockedUntil = &until
+			byEmail.Lockouts++
+			byEmail.Failures = 0
+			g.record(securityEvent{Type: "account_locked", IP: ip, Email: email, Detail: map[string]any{
+				"locked_until": until, "lockouts": byEmail.Lockouts,
+			}})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var byIP loginAttempts
+	return app.Store.modify(loginAttemptsBucket, "ip:"+ip, &byIP, func(bool) error {
+		byIP.Key = "ip:" + ip
+		if now.Sub(byIP.WindowStart) > g.Window {
+			byIP.Failures, byIP.WindowStart, byIP.Emails = 0, now, nil
+		}
+		byIP.Failures++
+		byIP.LastFailureAt = now
+
+		seen := false
+		for _, e := range byIP.Emails {
+			if e == email {
+				seen = true
+				break
+			}
+		}
+		if !seen && len(byIP.Emails) < g.StuffingThreshold {
+			byIP.Emails = append(byIP.Emails, email)
+		}
+
+		// one ip failing against many different accounts is credential stuffing, not a forgotten password
+		stuffing := !seen && len(byIP.Emails) == g.StuffingThreshold
+		if stuffing {
+			g.record(securityEvent{Type: "credential_stuffing", IP: ip, Detail: map[string]any{
+				"distinct_emails": len(byIP.Emails), "failures": byIP.Failures, "window": g.Window.String(),
+			}})
+		}
+
+		if stuffing || byIP.Failures >= g.IPMaxFailures {
+			until := now.Add(g.lockFor(byIP.Lockouts))
+			byIP.LockedUntil = &until
+			byIP.Lockouts++
+			byIP.Failures = 0
+			g.record(securityEvent{Type: "ip_locked", IP: ip, Detail: map[string]any{
+				"locked_until": until, "lockouts": byIP.Lockouts,
+			}})
+		}
+		return nil
+	})
+}
+
+// recordLoginSuccess forgets the failures of the email, the ip keeps its count so an attacker can't
+// reset it by logging into an account of their own
+func (app *Config) recordLoginSuccess(email string) error {
+	return app.Store.delete(loginAttemptsBucket, "email:"+email)
+}
+
+// guardLogin refuses locked logins and holds back the rest by their progressive delay, it reports
+// whether the login may go ahead
+func (app *Config) guardLogin(w http.ResponseWriter, r *http.Request, email string) bool {
+	locked, delay, err := app.checkLogin(email, clientIP(r))
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return false
+	}
+
+	if locked > 0 {
+		retryAfter := int(math.Ceil(locked.Seconds()))
+		app.audit(r, auditEvent{Type: auditLogin, Email: email, Status: http.StatusTooManyRequests, Outcome: outcomeDenied,
+			Detail: map[string]string{"reason": "locked out"}})
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		app.errorJSON(w, newCodedError("login.locked", "seconds", strconv.Itoa(retryAfter)),
+			map[string]any{"retry_after": retryAfter}, http.StatusTooManyRequests)
+		return false
+	}
+
+	if delay > 0 {
+		if err := sleepContext(r.Context(), delay); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// purgeLoginAttempts drops records whose window and lock have both run out, on every tick
+func (app *Config) purgeLoginAttempts(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var stale []string
+		now := time.Now()
+		err := app.Store.each(loginAttemptsBucket, func(key string, value []byte) error {
+			var attempts loginAttempts
+			if err := json.Unmarshal(value, &attempts); err == nil && !attempts.locked(now) &&
+				now.Sub(attempts.LastFailureAt) > app.Guard.MaxLockDuration {
+				stale = append(stale, key)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Println("error reading login attempts", err)
+			continue
+		}
+
+		for _, key := range stale {
+			if err := app.Store.delete(loginAttemptsBucket, key); err != nil {
+				log.Println("error purging login attempts", err)
+			}
+		}
+	}
+}
+
+// ListLockouts shows admins every email and ip with recent failures, ?locked=true only the locked ones
+func (app *Config) ListLockouts(w http.ResponseWriter, r *http.Request) {
+	onlyLocked := r.URL.Query().Get("locked") == "true"
+	now := time.Now()
+
+	lockouts := []map[string]any{}
+	err := app.Store.each(loginAttemptsBucket, func(_ string, value []byte) error {
+		var attempts loginAttempts
+		if err := json.Unmarshal(value, &attempts); err != nil {
+			return err
+		}
+		if onlyLocked && !attempts.locked(now) {
+			return nil
+		}
+		lockouts = append(lockouts, map[string]any{
+			"key":             attempts.Key,
+			"locked":          attempts.locked(now),
+			"locked_until":    attempts.LockedUntil,
+			"failures":        attempts.Failures,
+			"lockouts":        attempts.Lockouts,
+			"last_failure_at": attempts.LastFailureAt,
+			"distinct_emails": len(attempts.Emails),
+		})
+		return nil
+	})
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+
+	sort.Slice(lockouts, func(i, j int) bool {
+		return lockouts[i]["last_failure_at"].(time.Time).After(lockouts[j]["last_failure_at"].(time.Time))
+	})
+
+	var payload jsonResponse
+	payload.Error = false
+	payload.StatusCode = http.StatusOK
+	payload.Message = "login lockouts"
+	payload.Data = lockouts
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+// ClearLockout unlocks the email or ip given in the query and forgets its failures
+func (app *Config) ClearLockout(w http.ResponseWriter, r *http.Request) {
+	var key string
+	switch {
+	case r.URL.Query().Get("email") != "":
+		key = "email:" + normalizeLoginEmail(r.URL.Query().Get("email"))
+	case r.URL.Query().Get("ip") != "":
+		key = "ip:" + strings.TrimSpace(r.URL.Query().Get("ip"))
+	default:
+		app.errorJSON(w, errors.New("email or ip is required"), nil)
+		return
+	}
+
+	var attempts loginAttempts
+	found, err := app.Store.get(loginAttemptsBucket, key, &attempts)
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		app.errorJSON(w, errors.New("no failed logins recorded for "+key), nil, http.StatusNotFound)
+		return
+	}
+
+	err = app.Store.delete(loginAttemptsBucket, key)
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+
+	principal, _ := principalFrom(r.Context())
+	app.Guard.record(securityEvent{Type: "lockout_cleared", Detail: map[string]any{"key": key, "by": principal.UserID}})
+	app.audit(r, auditEvent{Type: "admin.lockout_cleared", Outcome: outcomeSuccess, Detail: map[string]string{"key": key}})
+
+	var payload jsonResponse
+	payload.Error = false
+	payload.StatusCode = http.StatusOK
+	payload.Message = "lockout cleared"
+	payload.Data = map[string]any{"key": key}
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+// SecurityEvents lists the most recent security events, newest first
+func (app *Config) SecurityEvents(w http.ResponseWriter, r *http.Request) {
+	events := app.Guard.recentEvents()
+	sort.SliceStable(events, func(i, j int) bool { return events[i].At.After(events[j].At) })
+
+	if eventType := r.URL.Query().Get("type"); eventType != "" {
+		filtered := []securityEvent{}
+		for _, event := range events {
+			if event.Type == eventType {
+				filtered = append(filtered, event)
+			}
+		}
+		events = filtered
+	}
+
+	var payload jsonResponse
+	payload.Error = false
+	payload.StatusCode = http.StatusOK
+	payload.Message = "security events"
+	payload.Data = events
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
@@ -3,27 +3,117 @@ package main
 import (
 	"fmt"
 	"log"
-	"net/http"
+	"time"
 )
 
 const webPort = "8080"
 
 type Config struct {
+	Networks  map[string]*posNetwork
+	Bridge    *bridgeTracker
+	Upstreams map[string]*upstreamPool
+	Verifier  *tokenVerifier
+	Policy    *accessPolicy
+	Store     *Store
+	Tokens    *tokenIssuer
+	Limiter   *rateLimiter
+	Guard     *loginGuard
+	Usage     *usageMeter
+	Audit     *auditLog
+	CORS      *corsConfig
+	Passwords *passwordPolicy
+	TwoFactor *twoFactorPolicy
+	SIWE      *siweConfig
 }
 
 func main() {
 
-	app := Config{}
+	//open the embedded store the broker keeps its own state in
+	store, err := openStore(envOr("STORE_PATH", "broker.db"))
+	if err != nil {
+		log.Panic(err)
+	}
+	defer store.Close()
+
+	app := Config{
+		Networks:  loadNetworks(),
+		Bridge:    newBridgeTracker(),
+		Upstreams: loadUpstreams(),
+		Verifier:  loadTokenVerifier(),
+		Policy:    loadAccessPolicy(),
+		Store:     store,
+		Tokens:    loadTokenIssuer(),
+		Limiter:   loadRateLimiter(),
+		Guard:     loadLoginGuard(),
+		Usage:     loadUsageMeter(),
+		Audit:     newAuditLog(),
+		CORS:      loadCORSConfig(),
+		Passwords: loadPasswordPolicy(),
+		TwoFactor: loadTwoFactorPolicy(),
+		SIWE:      loadSIWEConfig(),
+	}
+
+	//actively health check every upstream so bad nodes are ejected before requests hit them
+	healthInterval, err := time.ParseDuration(envOr("UPSTREAM_HEALTH_INTERVAL", "10s"))
+	if err != nil {
+		log.Panic(err)
+	}
+	for _, pool := range app.Upstreams {
+		go pool.healthCheck(healthInterval)
+	}
+
+	//keep tracked bridge transfers moving through their stages
+	pollInterval, err := time.ParseDuration(envOr("BRIDGE_POLL_INTERVAL", "30s"))
+	if err != nil {
+		log.Panic(err)
+	}
+	go app.Bridge.run(app.Networks, pollInterval)
 
+	//forget revoked tokens once they have expired on their own
+	go app.purgeRevokedTokens(time.Hour)
+
+	//forget sessions and their refresh tokens once they have expired
+	if app.Tokens != nil {
+		go app.purgeSessions(time.Hour)
+	}
+
+	//forget failed logins once their window and any lock have long run out
+	go app.purgeLoginAttempts(time.Hour)
+
+	//forget login challenges that were never answered
+	if app.TwoFactor != nil {
+		go app.purgeLoginChallenges(time.Hour)
+	} else {
+		log.Println("two-factor authentication is disabled, set TOTP_ENCRYPTION_KEY or BROKER_JWT_SECRET to enable it")
+	}
+
+	//forget sign-in with ethereum nonces once used or expired
+	if app.SIWE != nil {
+		go app.purgeSIWENonces(time.Hour)
+	} else {
+		log.Println("sign-in with ethereum is disabled, set SIWE_DOMAIN to the domain wallets sign in to enable it")
+	}
+
+	//append audit events to the hash chained log
+	if app.Audit != nil {
+		go app.Audit.run(app.Store)
+	} else {
+		log.Println("audit log is disabled, set AUDIT_HMAC_KEY or BROKER_JWT_SECRET to key it and enable it")
+	}
+
+	//write metered usage to the store
+	go app.persistUsage(envDuration("USAGE_FLUSH_INTERVAL", 10*time.Second))
+
+	//drop rate limit buckets of clients that went quiet
+	go app.Limiter.cleanup(time.Minute)
+
+	log.Println("cors policy", app.CORS.describe())
 	log.Printf("starting broker service on port %s\n", webPort)
 	//define http server
-	srv := &http.Server{
-		Addr:    fmt.Sprintf(":%s", webPort),
-		Handler: app.routes(),
-	}
+	srv := app.newServer(fmt.Sprintf(":%s", webPort))
 
 	//start the server
-	err := srv.ListenAndServe()
+	err = srv.ListenAndServe()
 	if err != nil {
 		log.Panic(err)
 	}
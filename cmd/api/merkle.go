@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// blocks are fetched from bor in batches of this size when building a checkpoint tree
+const blockBatchSize = 100
+
+// only the most recently used checkpoint trees are kept around
+const maxCachedTrees = 32
+
+// heimdall caps checkpoints at 1024 blocks, anything far beyond that is not worth fetching from bor
+const maxCheckpointBlocks = 4096
+
+// at most this many trees are built at once, every build fetches a whole checkpoint from bor
+const maxConcurrentTreeBuilds = 4
+
+// fetching the blocks of a tree gives up after this long
+const treeBuildTimeout = 2 * time.Minute
+
+type borBlockHeader struct {
+	Number           string `json:"number"`
+	Timestamp        string `json:"timestamp"`
+	TransactionsRoot string `json:"transactionsRoot"`
+	ReceiptsRoot     string `json:"receiptsRoot"`
+}
+
+// merkleTree holds every level of a checkpoint tree, levels[0] being the leaves
+type merkleTree struct {
+	levels [][][]byte
+}
+
+// treeBuild is a tree being built, callers asking for the same checkpoint wait on done instead of
+// fetching its blocks again
+type treeBuild struct {
+	done chan struct{}
+	tree *merkleTree
+	err  error
+}
+
+type cachedTree struct {
+	key  string
+	tree *merkleTree
+}
+
+// treeCache keeps the trees in least recently used order, the front of order being the newest
+type treeCache struct {
+	mu       sync.Mutex
+	trees    map[string]*list.Element
+	order    *list.List
+	building map[string]*treeBuild
+	slots    chan struct{}
+}
+
+var checkpointTrees = &treeCache{
+	trees:    map[string]*list.Element{},
+	order:    list.New(),
+	building: map[string]*treeBuild{},
+	slots:    make(chan struct{}, maxConcurrentTreeBuilds),
+}
+
+func (c *treeCache) put(key string, tree *merkleTree) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.trees[key]; ok {
+		element.Value.(*cachedTree).tree = tree
+		c.order.MoveToFront(element)
+		return
+	}
+	for c.order.Len() >= maxCachedTrees {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.trees, oldest.Value.(*cachedTree).key)
+	}
+	c.trees[key] = c.order.PushFront(&cachedTree{key: key, tree: tree})
+}
+
+// load returns the cached tree for key, or builds it with build. Concurrent callers for the same key
+// share one build, and no more than maxConcurrentTreeBuilds run at a time
+func (c *treeCache) load(ctx context.Context, key string, build func() (*merkleTree, error)) (*merkleTree, error) {
+	c.mu.Lock()
+	if element, ok := c.trees[key]; ok {
+		c.order.MoveToFront(element)
+		c.mu.Unlock()
+		return element.Value.(*cachedTree).tree, nil
+	}
+	call, running := c.building[key]
+	if !running {
+		call = &treeBuild{done: make(chan struct{})}
+		c.building[key] = call
+	}
+	c.mu.Unlock()
+
+	if !running {
+		go c.run(key, call, build)
+	}
+
+	select {
+	case <-call.done:
+		return call.tree, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *treeCache) run(key string, call *treeBuild, build func() (*merkleTree, error)) {
+	defer func() {
+		c.mu.Lock()
+		delete(c.building, key)
+		c.mu.Unlock()
+		close(call.done)
+	}()
+
+	c.slots <- struct{}{}
+	defer func() { <-c.slots }()
+
+	call.tree, call.err = build()
+	if call.err == nil {
+		c.put(key, call.tree)
+	}
+}
+
+func keccak256(data ...[]byte) []byte {
+	hash := sha3.NewLegacyKeccak256()
+	for _, d := range data {
+		hash.Write(d)
+	}
+	return hash.Sum(nil)
+}
+
+// blockHeaderLeaf hashes a bor header the same way the rootchain does:
+// keccak256(abi.encodePacked(number, timestamp, transactionsRoot, receiptsRoot))
+func blockHeaderLeaf(header borBlockHeader) ([]byte, error) {
+	number, err := hexUint64(header.Number)
+	if err != nil {
+		return nil, err
+	}
+	timestamp, err := hexUint64(header.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+	txRoot, err := decodeHex(header.TransactionsRoot)
+	if err != nil || len(txRoot) != 32 {
+		return nil, fmt.Errorf("invalid transactions root for block %d", number)
+	}
+	receiptsRoot, err := decodeHex(header.ReceiptsRoot)
+	if err != nil || len(receiptsRoot) != 32 {
+		return nil, fmt.Errorf("invalid receipts root for block %d", number)
+	}
+
+	numberWord, _ := decodeHex(abiUint(number))
+	timestampWord, _ := decodeHex(abiUint(timestamp))
+	return keccak256(numberWord, timestampWord, txRoot, receiptsRoot), nil
+}
+
+// newMerkleTree builds the tree bottom up, padding the leaves with zero hashes to a power of two
+func newMerkleTree(leaves [][]byte) *merkleTree {
+	size := 1
+	for size < len(leaves) {
+		size *= 2
+	}
+
+	level := make([][]byte, size)
+	copy(level, leaves)
+	for i := len(leaves); i < size; i++ {
+		level[i] = make([]byte, 32)
+	}
+
+	tree := &merkleTree{levels: [][][]byte{level}}
+	for len(level) > 1 {
+		next := make([][]byte, len(level)/2)
+		for i := range next {
+			next[i] = keccak256(level[2*i], level[2*i+1])
+		}
+		tree.levels = append(tree.levels, next)
+		level = next
+	}
+
+	return tree
+}
+
+func (t *merkleTree) root() []byte {
+	return t.levels[len(t.levels)-1][0]
+}
+
+// proof returns the sibling hashes from the leaf at index up to the root
+func (t *merkleTree) proof(index int) [][]byte {
+	var proof [][]byte
+	for _, level := range t.levels[:len(t.levels)-1] {
+		proof = append(proof, level[index^1])
+		index /= 2
+	}
+	return proof
+}
+
+// verifyMerkleProof checks membership the same way the rootchain Merkle library does
+func verifyMerkleProof(leaf []byte, index int, proof [][]byte, root []byte) bool {
+	node := leaf
+	for _, sibling := range proof {
+		if index%2 == 0 {
+			node = keccak256(node, sibling)
+		} else {
+			node = keccak256(sibling, node)
+		}
+		index /= 2
+	}
+	return bytes.Equal(node, root)
+}
+
+// checkpointTree builds, or returns the cached, header tree for the blocks of a checkpoint
+func checkpointTree(ctx context.Context, network *posNetwork, cp heimdallCheckpoint) (*merkleTree, error) {
+	start, end := uint64(cp.StartBlock), uint64(cp.EndBlock)
+	if end < start {
+		return nil, fmt.Errorf("checkpoint %d has an empty block range", cp.ID)
+	}
+	if end-start+1 > maxCheckpointBlocks {
+		return nil, fmt.Errorf("checkpoint %d spans %d blocks, more than the %d a tree is built for", cp.ID, end-start+1, maxCheckpointBlocks)
+	}
+
+	key := fmt.Sprintf("%s:%d", network.Name, cp.ID)
+	return checkpointTrees.load(ctx, key, func() (*merkleTree, error) {
+		//others may be waiting on the build too, so it is bounded by its own timeout and not
+		//cancelled with the request that started it
+		buildCtx, cancel := context.WithTimeout(context.Background(), treeBuildTimeout)
+		defer cancel()
+		return buildCheckpointTree(buildCtx, network, start, end)
+	})
+}
+
+// buildCheckpointTree fetches the headers of blocks start to end from bor and hashes them into a tree
+func buildCheckpointTree(ctx context.Context, network *posNetwork, start, end uint64) (*merkleTree, error) {
+	leaves := make([][]byte, 0, end-start+1)
+	for from := start; from <= end; from += blockBatchSize {
+		to := from + blockBatchSize - 1
+		if to > end {
+			to = end
+		}
+
+		calls := make([]rpcRequest, 0, to-from+1)
+		for n := from; n <= to; n++ {
+			calls = append(calls, rpcRequest{Method: "eth_getBlockByNumber", Params: []any{fmt.Sprintf("0x%x", n), false}})
+		}
+
+		results, err := rpcBatch(ctx, network.BorRPCURL, calls)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, result := range results {
+			var header borBlockHeader
+			err = json.Unmarshal(result, &header)
+			if err != nil {
+				return nil, err
+			}
+			if header.Number == "" {
+				return nil, errors.New("bor returned an empty block while building the checkpoint tree")
+			}
+
+			leaf, err := blockHeaderLeaf(header)
+			if err != nil {
+				return nil, err
+			}
+			leaves = append(leaves, leaf)
+		}
+	}
+
+	return newMerkleTree(leaves), nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type contextKey string
+
+const principalKey contextKey = "principal"
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	UserID   string         `json:"user_id"`
+	Email    string         `json:"email"`
+	Roles    []string       `json:"roles"`
+	Scopes   []string       `json:"scopes"`
+	APIKeyID string         `json:"api_key_id,omitempty"`
+	Token    string         `json:"-"`
+	Claims   map[string]any `json:"-"`
+}
+
+// HasRole reports whether the principal was granted role
+func (p *Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if strings.EqualFold(r, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// principalFrom returns the principal the authenticate middleware put in the context
+func principalFrom(ctx context.Context) (*Principal, bool) {
+	principal, ok := ctx.Value(principalKey).(*Principal)
+	return principal, ok
+}
+
+func withPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey, principal)
+}
+
+// authenticate verifies the api key or token of the request once and makes the principal available
+// to every handler of the group, requests without valid credentials never reach them
+func (app *Config) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if key := r.Header.Get(apiKeyHeader); key != "" {
+			principal, err := app.authenticateAPIKey(r.Context(), key)
+			if err != nil {
+				app.rejectAuth(w, r, err, nil, http.StatusUnauthorized)
+				return
+			}
+			if !app.requireTwoFactor(w, r, principal) {
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), principal)))
+			return
+		}
+
+		result, err := app.getUserToken(w, r)
+		if err != nil || result.Error {
+			//the auth service explains itself, otherwise say no more than unauthorized
+			var reason error = newCodedError("auth.unauthorized")
+			if result.Message != "" {
+				reason = errors.New(result.Message)
+			}
+			app.rejectAuth(w, r, reason, result.Data, http.StatusUnauthorized)
+			return
+		}
+
+		principal, err := principalFromData(result.Data)
+		if err != nil {
+			app.rejectAuth(w, r, err, nil, http.StatusUnauthorized)
+			return
+		}
+		principal.Token, _ = bearerToken(r)
+
+		//logged out tokens stay valid cryptographically, so check the revocation list
+		revoked, err := app.isTokenRevoked(principal.Token)
+		if err != nil {
+			app.errorJSON(w, err, nil, http.StatusInternalServerError)
+			return
+		}
+		if revoked {
+			app.rejectAuth(w, r, newCodedError("auth.token_revoked"), nil, http.StatusUnauthorized)
+			return
+		}
+
+		//a force logout ends every token the user had by then, including those of the auth service
+		revoked, err = app.revokedByForceLogout(principal)
+		if err != nil {
+			app.errorJSON(w, err, nil, http.StatusInternalServerError)
+			return
+		}
+		if revoked {
+			app.rejectAuth(w, r, newCodedError("auth.token_revoked"), nil, http.StatusUnauthorized)
+			return
+		}
+
+		//tokens of roles that require two-factor only work once the account has it, whoever issued them
+		if !app.requireTwoFactor(w, r, principal) {
+			return
+		}
+
+		//a session revoked from another device or by an admin takes its access tokens with it
+		if sessionID := app.sessionID(principal); sessionID != "" {
+			err := app.touchSession(sessionID, clientIP(r))
+			if errors.Is(err, errSessionRevoked) {
+				app.rejectAuth(w, r, err, nil, http.StatusUnauthorized)
+				return
+			}
+			if err != nil {
+				app.errorJSON(w, err, nil, http.StatusInternalServerError)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), principal)))
+	})
+}
+
+// requireTwoFactor rejects principals whose roles require two-factor when their account hasn't got it
+func (app *Config) requireTwoFactor(w http.ResponseWriter, r *http.Request, principal *Principal) bool {
+	satisfied, err := app.twoFactorSatisfied(principal)
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return false
+	}
+	if !satisfied {
+		app.rejectAuth(w, r, errTwoFactorRequired, nil, http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// principalFromData builds the principal from verified token claims or from the user the auth
+// service returned, which may be wrapped in a "user" object
+func principalFromData(data any) (*Principal, error) {
+	claims, ok := data.(map[string]any)
+	if !ok {
+		return nil, errors.New("token does not identify a user")
+	}
+	if user, ok := claims["user"].(map[string]any); ok {
+		claims = user
+	}
+
+	principal := &Principal{Claims: claims}
+	principal.UserID = firstString(claims, "sub", "user_id", "id")
+	principal.Email = firstString(claims, "email")
+	principal.Roles = stringList(claims, "roles", "role")
+	principal.Scopes = stringList(claims, "scopes", "scope", "scp")
+
+	if principal.UserID == "" {
+		return nil, errors.New("token does not identify a user")
+	}
+	return principal, nil
+}
+
+func firstString(claims map[string]any, keys ...string) string {
+	for _, key := range keys {
+		switch value := claims[key].(type) {
+		case string:
+			if value != "" {
+				return value
+			}
+		case float64:
+			return fmt.Sprintf("%.0f", value)
+		}
+	}
+	return ""
+}
+
+// stringList reads a claim that is either a list of strings or a space separated string
+func stringList(claims map[string]any, keys ...string) []string {
+	for _, key := range keys {
+		switch value := claims[key].(type) {
+		case string:
+			if value != "" {
+				return strings.Fields(value)
+			}
+		case []any:
+			var list []string
+			for _, v := range value {
+				if s, ok := v.(string); ok {
+					list = append(list, s)
+				}
+			}
+			return list
+		case []string:
+			return value
+		}
+	}
+	return nil
+}
+
+// forwardPrincipal tells a downstream service who the broker authenticated
+func forwardPrincipal(ctx context.Context, request *http.Request) {
+	principal, ok := principalFrom(ctx)
+	if !ok {
+		return
+	}
+	request.Header.Set("X-User-ID", principal.UserID)
+	if principal.Email != "" {
+		request.Header.Set("X-User-Email", principal.Email)
+	}
+	if len(principal.Roles) > 0 {
+		request.Header.Set("X-User-Roles", strings.Join(principal.Roles, ","))
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// posNetwork holds the chain endpoints the broker talks to directly for a POS network
+type posNetwork struct {
+	Name               string
+	HeimdallURL        string
+	BorRPCURL          string
+	EthRPCURL          string
+	RootChainAddress   string
+	StateSenderAddress string
+}
+
+// loadNetworks reads the per network endpoints from the environment, falling back to public defaults
+func loadNetworks() map[string]*posNetwork {
+	return map[string]*posNetwork{
+		"mainnet": {
+			Name:               "mainnet",
+			HeimdallURL:        envOr("MAINNET_HEIMDALL_URL", "https://heimdall-api.polygon.technology/"),
+			BorRPCURL:          envOr("MAINNET_BOR_RPC_URL", "https://polygon-rpc.com"),
+			EthRPCURL:          os.Getenv("MAINNET_ETH_RPC_URL"),
+			RootChainAddress:   envOr("MAINNET_ROOT_CHAIN_ADDRESS", "0x86E4Dc95c7FBdBf52e33D563BbDB00823894C287"),
+			StateSenderAddress: envOr("MAINNET_STATE_SENDER_ADDRESS", "0x28e4F3a7f651294B9564800b2D01f35189A5bFbE"),
+		},
+		"testnet": {
+			Name:               "testnet",
+			HeimdallURL:        envOr("TESTNET_HEIMDALL_URL", "https://heimdall-api-amoy.polygon.technology/"),
+			BorRPCURL:          envOr("TESTNET_BOR_RPC_URL", "https://rpc-amoy.polygon.technology"),
+			EthRPCURL:          os.Getenv("TESTNET_ETH_RPC_URL"),
+			RootChainAddress:   envOr("TESTNET_ROOT_CHAIN_ADDRESS", "0xbd07D7E1E93c8d4b2a261327F3C28a8EA7167209"),
+			StateSenderAddress: envOr("TESTNET_STATE_SENDER_ADDRESS", "0x49E307Fa5a58ff1834E0F8a60eB2a9609E6A5F50"),
+		},
+	}
+}
+
+// network resolves the {network} url param of the request
+func (app *Config) network(r *http.Request) (*posNetwork, error) {
+	name := strings.ToLower(chi.URLParam(r, "network"))
+	network, ok := app.Networks[name]
+	if !ok {
+		return nil, errors.New("unknown network, expected mainnet or testnet")
+	}
+	return network, nil
+}
+
+func envOr(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
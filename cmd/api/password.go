@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	_ "embed"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+//go:embed common_passwords.txt
+var commonPasswordList string
+
+var commonPasswords = loadCommonPasswords()
+
+// leetReplacer undoes the substitutions people expect to make a common password safe
+var leetReplacer = strings.NewReplacer("@", "a", "4", "a", "3", "e", "1", "i", "!", "i", "0", "o", "$", "s", "5", "s", "7", "t")
+
+var strengthLabels = []string{"very weak", "weak", "fair", "strong", "very strong"}
+
+// passwordPolicy holds the password rules that come from the environment, passphrases of at least
+// PassphraseLength characters don't need MinClasses
+type passwordPolicy struct {
+	MinLength        int
+	MaxLength        int
+	MinClasses       int
+	MinScore         int
+	PassphraseLength int
+}
+
+// passwordProblem is one rule a password broke, its message is the catalog entry password.<code>
+type passwordProblem struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+
+	params map[string]string
+}
+
+// passwordStrength is the score of a password from 0 to 4 and what keeps it from being accepted
+type passwordStrength struct {
+	Score       int               `json:"score"`
+	Label       string            `json:"label"`
+	Entropy     float64           `json:"entropy_bits"`
+	Problems    []passwordProblem `json:"problems,omitempty"`
+	Suggestions []string          `json:"suggestions,omitempty"`
+
+	suggestionCodes []string
+}
+
+// localize translates the problems and suggestions, the label stays as the stable name of the score
+func (s *passwordStrength) localize(lang string) {
+	for i := range s.Problems {
+		s.Problems[i].Message = localize(lang, "password."+s.Problems[i].Code, s.Problems[i].params)
+	}
+	for i, code := range s.suggestionCodes {
+		s.Suggestions[i] = localize(lang, code, nil)
+	}
+}
+
+func loadPasswordPolicy() *passwordPolicy {
+	return &passwordPolicy{
+		MinLength:        envInt("PASSWORD_MIN_LENGTH", 10),
+		MaxLength:        envInt("PASSWORD_MAX_LENGTH", 128),
+		MinClasses:       envInt("PASSWORD_MIN_CLASSES", 3),
+		MinScore:         min(max(envInt("PASSWORD_MIN_SCORE", 2), 0), len(strengthLabels)-1),
+		PassphraseLength: envInt("PASSWORD_PASSPHRASE_LENGTH", 20),
+	}
+}
+
+func loadCommonPasswords() map[string]bool {
+	passwords := map[string]bool{}
+	scanner := bufio.NewScanner(strings.NewReader(commonPasswordList))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			passwords[strings.ToLower(line)] = true
+		}
+	}
+	return passwords
+}
+
+// isCommonPassword also catches P@ssw0rd and password123! as password
+func isCommonPassword(password string) bool {
+	lower := strings.ToLower(password)
+	if commonPasswords[lower] {
+		return true
+	}
+	stripped := strings.TrimRightFunc(lower, func(r rune) bool { return unicode.IsDigit(r) || unicode.IsPunct(r) || unicode.IsSymbol(r) })
+	return commonPasswords[stripped] || commonPasswords[leetReplacer.Replace(lower)] || commonPasswords[leetReplacer.Replace(stripped)]
+}
+
+// characterClasses counts lowercase, uppercase, digits and symbols, and the alphabet they add up to
+func characterClasses(password string) (int, int) {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range password {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < utf8.RuneSelf:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+
+	classes, alphabet := 0, 0
+	for _, class := range []struct {
+		present bool
+		size    int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if class.present {
+			classes++
+			alphabet += class.size
+		}
+	}
+	// letters beyond ascii count as a class of their own
+	if classes > 4 {
+		classes = 4
+	}
+	return classes, alphabet
+}
+
+// estimateEntropy counts every character of a run like aaa or a sequence like abc or 321 as a
+// single bit, as those are the first things a cracker tries
+func estimateEntropy(password string) float64 {
+	runes := []rune(password)
+	_, alphabet := characterClasses(password)
+	if len(runes) == 0 || alphabet == 0 {
+		return 0
+	}
+	perChar := math.Log2(float64(alphabet))
+
+	predictable := make([]bool, len(runes))
+	for i := 2; i < len(runes); i++ {
+		a, b, c := runes[i-2], runes[i-1], runes[i]
+		run := a == b && b == c
+		sequence := b-a == c-b && (b-a == 1 || b-a == -1)
+		if run || sequence {
+			predictable[i-1], predictable[i] = true, true
+		}
+	}
+
+	entropy := 0.0
+	for i := range runes {
+		if predictable[i] {
+			entropy++
+		} else {
+			entropy += perChar
+		}
+	}
+	return entropy
+}
+
+func scoreEntropy(entropy float64) int {
+	switch {
+	case entropy < 28:
+		return 0
+	case entropy < 36:
+		return 1
+	case entropy < 60:
+		return 2
+	case entropy < 80:
+		return 3
+	}
+	return 4
+}
+
+// check scores password and lists every rule it breaks. personal holds what the password must not
+// contain, like the name and email of the user
+func (policy *passwordPolicy) check(password string, personal ...string) (passwordStrength, bool) {
+	strength := passwordStrength{Entropy: math.Round(estimateEntropy(password)*10) / 10}
+	strength.Score = scoreEntropy(strength.Entropy)
+
+	//params are name, value pairs for the message of the problem
+	problem := func(code, suggestion string, params ...string) {
+		values := messageParams(params)
+		strength.Problems = append(strength.Problems, passwordProblem{Code: code, Message: localize(defaultLanguage, "password."+code, values), params: values})
+		if suggestion != "" {
+			suggestion = "password.suggest." + suggestion
+			strength.suggestionCodes = append(strength.suggestionCodes, suggestion)
+			strength.Suggestions = append(strength.Suggestions, localize(defaultLanguage, suggestion, nil))
+		}
+	}
+
+	length := utf8.RuneCountInString(password)
+	if length < policy.MinLength {
+		problem("too_short", "passphrase", "min", strconv.Itoa(policy.MinLength))
+	}
+	if length > policy.MaxLength {
+		problem("too_long", "", "max", strconv.Itoa(policy.MaxLength))
+	}
+
+	if classes, _ := characterClasses(password); classes < policy.MinClasses && length < policy.PassphraseLength {
+		problem("character_classes", "classes", "classes", strconv.Itoa(policy.MinClasses))
+	}
+
+	if isCommonPassword(password) {
+		strength.Score = 0
+		problem("common", "common")
+	}
+
+	lower := strings.ToLower(password)
+	for _, value := range personal {
+		if value = strings.ToLower(strings.TrimSpace(value)); utf8.RuneCountInString(value) >= 3 && strings.Contains(lower, value) {
+			strength.Score = min(strength.Score, 1)
+			problem("personal_info", "personal_info")
+			break
+		}
+	}
+
+	// any other problem already explains a low score
+	if strength.Score < policy.MinScore && len(strength.Problems) == 0 {
+		problem("weak", "patterns", "score", strconv.Itoa(strength.Score), "required", strconv.Itoa(policy.MinScore))
+	}
+
+	strength.Label = strengthLabels[strength.Score]
+	return strength, len(strength.Problems) == 0
+}
+
+// checkSignupPassword applies the password policy to the payload, the strength report is returned
+// with the field error so the client can show why
+func (app *Config) checkSignupPassword(payload SignupPayload) error {
+	local, _, _ := strings.Cut(payload.Email, "@")
+	phone := strings.TrimPrefix(payload.Phone, "+")
+	if len(phone) > 7 {
+		phone = phone[len(phone)-7:]
+	}
+
+	strength, ok := app.Passwords.check(payload.Password, payload.FirstName, payload.LastName, local, phone)
+	if ok {
+		return nil
+	}
+	first := strength.Problems[0]
+	return &validationError{Fields: []fieldError{{
+		Field:   "password",
+		Rule:    "policy",
+		Code:    "password." + first.Code,
+		Message: first.Message,
+		Detail:  &strength,
+		params:  first.params,
+	}}}
+}
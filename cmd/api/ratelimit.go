@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// buckets that have not been touched for this long are dropped
+const bucketIdleTimeout = 10 * time.Minute
+
+// rateTier is a token bucket configuration, Limit requests per Period with bursts of up to Burst
+type rateTier struct {
+	Name   string
+	Limit  int
+	Period time.Duration
+	Burst  int
+}
+
+func (t rateTier) ratePerSecond() float64 {
+	return float64(t.Limit) / t.Period.Seconds()
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// rateLimiter keeps a token bucket per tier and client
+type rateLimiter struct {
+	Tiers map[string]rateTier
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// defaultRateTiers apply unless RATE_LIMIT_TIERS overrides them. ip limits each address before its
+// credentials are checked, it is generous as many users may share one address
+const defaultRateTiers = "auth=10/1m:20;ip=600/1m:600;default=300/1m:300;pos=120/1m:60"
+
+// loadRateLimiter parses RATE_LIMIT_TIERS, a ; separated list of name=limit/period[:burst], e.g.
+// "auth=10/1m:20;pos=120/1m:60"
+func loadRateLimiter() *rateLimiter {
+	limiter := &rateLimiter{Tiers: map[string]rateTier{}, buckets: map[string]*tokenBucket{}}
+
+	for _, config := range []string{defaultRateTiers, os.Getenv("RATE_LIMIT_TIERS")} {
+		for _, entry := range strings.Split(config, ";") {
+			if strings.TrimSpace(entry) == "" {
+				continue
+			}
+			tier, err := parseRateTier(strings.TrimSpace(entry))
+			if err != nil {
+				log.Println("ignoring rate limit tier", entry, err)
+				continue
+			}
+			limiter.Tiers[tier.Name] = tier
+		}
+	}
+
+	return limiter
+}
+
+func parseRateTier(entry string) (rateTier, error) {
+	name, spec, ok := strings.Cut(entry, "=")
+	if !ok {
+		return rateTier{}, errors.New("expected name=limit/period[:burst]")
+	}
+	spec, burst, hasBurst := strings.Cut(spec, ":")
+	limit, period, ok := strings.Cut(spec, "/")
+	if !ok {
+		return rateTier{}, errors.New("expected limit/period")
+	}
+
+	tier := rateTier{Name: name}
+	var err error
+	tier.Limit, err = strconv.Atoi(limit)
+	if err != nil || tier.Limit <= 0 {
+		return rateTier{}, errors.New("limit must be a positive integer")
+	}
+	tier.Period, err = time.ParseDuration(period)
+	if err != nil || tier.Period <= 0 {
+		return rateTier{}, errors.New("period must be a positive duration")
+	}
+	tier.Burst = tier.Limit
+	if hasBurst {
+		tier.Burst, err = strconv.Atoi(burst)
+		if err != nil || tier.Burst <= 0 {
+			return rateTier{}, errors.New("burst must be a positive integer")
+		}
+	}
+	return tier, nil
+}
+
+// take removes a token from the bucket of key, returning whether the request is allowed, the tokens
+// left and how long until the bucket is full again or, when denied, until the next token
+func (l *rateLimiter) take(tier rateTier, key string) (bool, int, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	rate := tier.ratePerSecond()
+	bucketKey := tier.Name + ":" + key
+
+	bucket, ok := l.buckets[bucketKey]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(tier.Burst), updated: now}
+		l.buckets[bucketKey] = bucket
+	}
+
+	bucket.tokens = math.Min(float64(tier.Burst), bucket.tokens+now.Sub(bucket.updated).Seconds()*rate)
+	bucket.updated = now
+
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+		return false, 0, wait
+	}
+
+	bucket.tokens--
+	full := time.Duration((float64(tier.Burst) - bucket.tokens) / rate * float64(time.Second))
+	return true, int(bucket.tokens), full
+}
+
+// cleanup drops idle buckets on every tick, a full bucket holds no state worth keeping
+func (l *rateLimiter) cleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		l.mu.Lock()
+		for key, bucket := range l.buckets {
+			if time.Since(bucket.updated) > bucketIdleTimeout {
+				delete(l.buckets, key)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// rateLimit limits the requests of every client per tier, clients are keyed by api key, user or ip
+func (app *Config) rateLimit(tierName string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tier, ok := app.Limiter.Tiers[tierName]
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			allowed, remaining, reset := app.Limiter.take(tier, rateLimitKey(r))
+
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(tier.Burst))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(reset.Seconds()))))
+			w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d;burst=%d", tier.Limit, int(tier.Period.Seconds()), tier.Burst))
+
+			if !allowed {
+				retryAfter := int(math.Ceil(reset.Seconds()))
+				w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+				app.errorJSON(w, newCodedError("rate_limit.exceeded", "seconds", strconv.Itoa(retryAfter)),
+					map[string]any{"tier": tier.Name, "retry_after": retryAfter}, http.StatusTooManyRequests)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func rateLimitKey(r *http.Request) string {
+	if principal, ok := principalFrom(r.Context()); ok {
+		if principal.APIKeyID != "" {
+			return "key:" + principal.APIKeyID
+		}
+		return "user:" + principal.UserID
+	}
+	return "ip:" + clientIP(r)
+}
+
+// clientIP returns the address of the client, X-Forwarded-For is only trusted with TRUST_PROXY=true.
+// Every proxy appends the address it got the request from, so with TRUSTED_PROXY_HOPS proxies in
+// front of the broker the client is that many entries from the right. Anything left of it was sent
+// by the client and can't be trusted
+func clientIP(r *http.Request) string {
+	if os.Getenv("TRUST_PROXY") == "true" {
+		var entries []string
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			for _, entry := range strings.Split(header, ",") {
+				if entry = strings.TrimSpace(entry); entry != "" {
+					entries = append(entries, entry)
+				}
+			}
+		}
+
+		if len(entries) > 0 {
+			hops := envInt("TRUSTED_PROXY_HOPS", 1)
+			if hops < 1 {
+				hops = 1
+			}
+			// fewer entries than proxies, the leftmost was still added by one of them
+			index := len(entries) - hops
+			if index < 0 {
+				index = 0
+			}
+			if ip := net.ParseIP(entries[index]); ip != nil {
+				return ip.String()
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
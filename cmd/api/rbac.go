@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	roleAdmin     = "admin"
+	roleOperator  = "operator"
+	roleViewer    = "viewer"
+	roleAPIClient = "api-client"
+)
+
+const (
+	permUsersRead     = "users:read"
+	permPOSRead       = "pos:read"
+	permBridgeTrack   = "bridge:track"
+	permUpstreamsRead = "upstreams:read"
+
+	permSecurityManage = "security:manage"
+	permUsageRead      = "usage:read"
+	permAuditRead      = "audit:read"
+	permSessionsManage = "sessions:manage"
+)
+
+// rolePermissions lists what every role may do, admin is granted everything
+var rolePermissions = map[string][]string{
+	roleAdmin:     {"*"},
+	roleOperator:  {permPOSRead, permBridgeTrack, permUpstreamsRead},
+	roleViewer:    {permPOSRead},
+	roleAPIClient: {permPOSRead, permBridgeTrack},
+}
+
+// accessPolicy holds the role settings that come from the environment
+type accessPolicy struct {
+	DefaultRole  string
+	NetworkRoles map[string][]string
+}
+
+// loadAccessPolicy reads RBAC_DEFAULT_ROLE, given to principals the auth service assigned no role,
+// and NETWORK_ROLES, e.g. "mainnet=admin,operator;testnet=admin,operator,viewer"
+func loadAccessPolicy() *accessPolicy {
+	policy := &accessPolicy{
+		DefaultRole:  envOr("RBAC_DEFAULT_ROLE", roleViewer),
+		NetworkRoles: map[string][]string{},
+	}
+
+	for _, entry := range strings.Split(os.Getenv("NETWORK_ROLES"), ";") {
+		network, roles, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			continue
+		}
+		for _, role := range strings.Split(roles, ",") {
+			if role = strings.TrimSpace(role); role != "" {
+				policy.NetworkRoles[strings.ToLower(network)] = append(policy.NetworkRoles[strings.ToLower(network)], role)
+			}
+		}
+	}
+
+	return policy
+}
+
+// roles returns the roles of the principal, or the default role when it has none
+func (policy *accessPolicy) roles(principal *Principal) []string {
+	if len(principal.Roles) == 0 {
+		return []string{policy.DefaultRole}
+	}
+	return principal.Roles
+}
+
+// can reports whether any role of the principal grants permission, api keys are further limited
+// to the scopes they were created with
+func (policy *accessPolicy) can(principal *Principal, permission string) bool {
+	if principal.APIKeyID != "" && len(principal.Scopes) > 0 {
+		scoped := false
+		for _, scope := range principal.Scopes {
+			if scope == permission {
+				scoped = true
+				break
+			}
+		}
+		if !scoped {
+			return false
+		}
+	}
+
+	for _, role := range policy.roles(principal) {
+		for _, granted := range rolePermissions[strings.ToLower(role)] {
+			if granted == "*" || granted == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// requirePermission only lets principals holding permission through, everyone else gets a 403
+func (app *Config) requirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal, ok := principalFrom(r.Context())
+			if !ok {
+				app.errorJSON(w, newCodedError("auth.unauthorized"), nil, http.StatusUnauthorized)
+				return
+			}
+
+			if !app.Policy.can(principal, permission) {
+				app.errorJSON(w, newCodedError("auth.missing_permission", "permission", permission), map[string]string{"missing_permission": permission}, http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// restrictNetwork enforces NETWORK_ROLES on the /api/v1/pos/{network}/... routes
+func (app *Config) restrictNetwork(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		network := networkFromPath(r.URL.Path)
+		allowed, restricted := app.Policy.NetworkRoles[network]
+		if !restricted {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		principal, ok := principalFrom(r.Context())
+		if !ok {
+			app.errorJSON(w, newCodedError("auth.unauthorized"), nil, http.StatusUnauthorized)
+			return
+		}
+
+		for _, role := range app.Policy.roles(principal) {
+			for _, a := range allowed {
+				if strings.EqualFold(role, a) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+		}
+
+		app.errorJSON(w, newCodedError("auth.network_restricted", "network", network, "roles", strings.Join(allowed, ", ")),
+			map[string]any{"network": network, "allowed_roles": allowed}, http.StatusForbidden)
+	})
+}
+
+// networkFromPath returns the network segment of a /api/v1/pos/{network}/... path
+func networkFromPath(path string) string {
+	rest, ok := strings.CutPrefix(path, "/api/v1/pos/")
+	if !ok {
+		return ""
+	}
+	network, _, _ := strings.Cut(rest, "/")
+	return strings.ToLower(network)
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	sessionsBucket      = "sessions"
+	refreshTokensBucket = "refresh_tokens"
+	refreshCookie       = "broker_refresh"
+	refreshCookiePath   = "/api/v1/authentication"
+	csrfCookie          = "broker_csrf"
+	csrfHeader          = "X-CSRF-Token"
+)
+
+var (
+	errInvalidRefreshToken = errors.New("invalid refresh token")
+	errRefreshTokenExpired = errors.New("refresh token has expired")
+	errRefreshTokenReused  = errors.New("refresh token was already used, the session has been revoked")
+	errSessionRevoked      = newCodedError("auth.session_revoked")
+	errSessionNotFound     = errors.New("session not found")
+	errInvalidCSRFToken    = errors.New("missing or invalid " + csrfHeader + " header")
+)
+
+type RefreshPayload struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// session is one login, and with it one family of rotated refresh tokens
+type session struct {
+	ID           string     `json:"id"`
+	UserID       string     `json:"user_id"`
+	Email        string     `json:"email,omitempty"`
+	Roles        []string   `json:"roles,omitempty"`
+	IP           string     `json:"ip"`
+	UserAgent    string     `json:"user_agent,omitempty"`
+	Device       string     `json:"device"`
+	LastIP       string     `json:"last_ip"`
+	CreatedAt    time.Time  `json:"created_at"`
+	LastUsedAt   time.Time  `json:"last_used_at"`
+	ExpiresAt    time.Time  `json:"expires_at"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+	RevokeReason string     `json:"revoke_reason,omitempty"`
+}
+
+// refreshToken is stored keyed by the hash of the token, it may be used exactly once
+type refreshToken struct {
+	SessionID string     `json:"session_id"`
+	IssuedAt  time.Time  `json:"issued_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	CSRFHash  string     `json:"csrf_hash"`
+}
+
+// tokenPair is what Login and Refresh hand out to the client
+type tokenPair struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	SessionID    string `json:"session_id"`
+	CSRFToken    string `json:"csrf_token"`
+}
+
+// startSession opens a new session for the principal on the device of the request and issues its
+// first token pair
+func (app *Config) startSession(w http.ResponseWriter, r *http.Request, principal *Principal) (tokenPair, error) {
+	id, err := randomString(8)
+	if err != nil {
+		return tokenPair{}, err
+	}
+
+	now := time.Now().UTC()
+	ip := clientIP(r)
+	s := session{
+		ID:         id,
+		UserID:     principal.UserID,
+		Email:      principal.Email,
+		Roles:      principal.Roles,
+		IP:         ip,
+		UserAgent:  r.UserAgent(),
+		Device:     describeDevice(r.UserAgent()),
+		LastIP:     ip,
+		CreatedAt:  now,
+		LastUsedAt: now,
+		ExpiresAt:  now.Add(app.Tokens.RefreshTTL),
+	}
+	err = app.Store.put(sessionsBucket, s.ID, s)
+	if err != nil {
+		return tokenPair{}, err
+	}
+
+	return app.issueTokens(w, s)
+}
+
+// issueTokens mints an access token and the next refresh token of the session
+func (app *Config) issueTokens(w http.ResponseWriter, s session) (tokenPair, error) {
+	principal := &Principal{UserID: s.UserID, Email: s.Email, Roles: s.Roles}
+	access, expiresAt, err := app.Tokens.accessToken(principal, s.ID)
+	if err != nil {
+		return tokenPair{}, err
+	}
+
+	secret, err := randomString(32)
+	if err != nil {
+		return tokenPair{}, err
+	}
+	plain := "rt_" + secret
+
+	// refreshing with the cookie needs this token in a header too, which other sites can't send
+	csrf, err := randomString(16)
+	if err != nil {
+		return tokenPair{}, err
+	}
+
+	now := time.Now().UTC()
+	err = app.Store.put(refreshTokensBucket, hashSecret(plain), refreshToken{
+		SessionID: s.ID,
+		IssuedAt:  now,
+		ExpiresAt: s.ExpiresAt,
+		CSRFHash:  hashSecret(csrf),
+	})
+	if err != nil {
+		return tokenPair{}, err
+	}
+
+	// browsers get the refresh token as a cookie the page scripts can't read
+	http.SetCookie(w, &http.Cookie{
+		Name:     refreshCookie,
+		Value:    plain,
+		Path:     refreshCookiePath,
+		Expires:  s.ExpiresAt,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	// pages of the same site read the csrf token from this cookie, others from the response
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    csrf,
+		Path:     "/",
+		Expires:  s.ExpiresAt,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	return tokenPair{
+		AccessToken:  access,
+		RefreshToken: plain,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(time.Until(expiresAt).Seconds()),
+		SessionID:    s.ID,
+		CSRFToken:    csrf,
+	}, nil
+}
+
+// revokeSession ends a session, every refresh token of its family stops working
+func (app *Config) revokeSession(id, reason string) error {
+	var s session
+	return app.Store.modify(sessionsBucket, id, &s, func(found bool) error {
+		if !found {
+			return errSessionNotFound
+		}
+		if s.RevokedAt == nil {
+			now := time.Now().UTC()
+			s.RevokedAt = &now
+			s.RevokeReason = reason
+		}
+		return nil
+	})
+}
+
+// withTokens adds the broker tokens to the data the auth service returned on login
+func withTokens(data any, tokens tokenPair) any {
+	return mergeData(data, map[string]any{
+		"access_token":  tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"token_type":    tokens.TokenType,
+		"expires_in":    tokens.ExpiresIn,
+		"session_id":    tokens.SessionID,
+		"csrf_token":    tokens.CSRFToken,
+	})
+}
+
+// mergeData adds values to the data of a response, data that isn't an object moves under auth
+func mergeData(data any, values map[string]any) any {
+	merged := map[string]any{}
+	if m, ok := data.(map[string]any); ok {
+		for k, v := range m {
+			merged[k] = v
+		}
+	} else if data != nil {
+		merged["auth"] = data
+	}
+
+	for k, v := range values {
+		merged[k] = v
+	}
+	return merged
+}
+
+// refreshingAccount resolves the account of the session a refresh token belongs to. Unknown tokens
+// give no account and no error, spending the token rejects them. A session whose account is gone or
+// disabled is revoked
+func (app *Config) refreshingAccount(ctx context.Context, hash string) (*Principal, error) {
+	var rt refreshToken
+	found, err := app.Store.get(refreshTokensBucket, hash, &rt)
+	if err != nil || !found {
+		return nil, err
+	}
+	var s session
+	found, err = app.Store.get(sessionsBucket, rt.SessionID, &s)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	account, err := app.resolveAccount(ctx, &Principal{UserID: s.UserID, Email: s.Email, Roles: s.Roles})
+	if errors.Is(err, errAccountUnavailable) {
+		if revokeErr := app.revokeSession(s.ID, "account is no longer available"); revokeErr != nil {
+			return nil, revokeErr
+		}
+	}
+	return account, err
+}
+
+// purgeSessions drops refresh tokens and sessions that have expired, on every tick. Used refresh
+// tokens are kept until then to catch their reuse
+func (app *Config) purgeSessions(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+		for _, bucket := range []string{refreshTokensBucket, sessionsBucket} {
+			var expired []string
+			err := app.Store.each(bucket, func(key string, value []byte) error {
+				var entry struct {
+					ExpiresAt time.Time `json:"expires_at"`
+				}
+				if err := json.Unmarshal(value, &entry); err == nil && now.After(entry.ExpiresAt) {
+					expired = append(expired, key)
+				}
+				return nil
+			})
+			if err != nil {
+				log.Println("error reading", bucket, err)
+				continue
+			}
+
+			for _, key := range expired {
+				if err := app.Store.delete(bucket, key); err != nil {
+					log.Println("error purging", bucket, err)
+				}
+			}
+		}
+	}
+}
+
+func (app *Config) Refresh(w http.ResponseWriter, r *http.Request) {
+	if app.Tokens == nil {
+		app.errorJSON(w, errors.New("refresh tokens are not enabled"), nil, http.StatusNotFound)
+		return
+	}
+
+	var requestPayload RefreshPayload
+	if r.ContentLength != 0 {
+		err := app.readJSON(w, r, &requestPayload)
+		if err != nil {
+			app.errorJSON(w, err, nil)
+			return
+		}
+	}
+	fromCookie := false
+	if requestPayload.RefreshToken == "" {
+		if cookie, err := r.Cookie(refreshCookie); err == nil {
+			requestPayload.RefreshToken = cookie.Value
+			fromCookie = true
+		}
+	}
+	if requestPayload.RefreshToken == "" {
+		app.errorJSON(w, errors.New("refresh_token is required"), nil)
+		return
+	}
+
+	//the browser attaches the cookie to requests of any site, so those must prove where they come from
+	if fromCookie && !app.CORS.sameOrigin(r) {
+		app.errorJSON(w, errors.New("origin is not allowed to refresh with the session cookie"), nil, http.StatusForbidden)
+		return
+	}
+
+	//the session takes the roles the account holds now. They are looked up before the token is spent,
+	//so an auth service that is down doesn't cost the user their session
+	hash := hashSecret(requestPayload.RefreshToken)
+	account, err := app.refreshingAccount(r.Context(), hash)
+	if errors.Is(err, errAccountUnavailable) {
+		app.errorJSON(w, err, nil, http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusBadGateway)
+		return
+	}
+	if account != nil && !app.requireTwoFactor(w, r, account) {
+		return
+	}
+
+	// mark the token used in the same transaction that checks it, so it can only ever be spent once
+	now := time.Now().UTC()
+	var rt refreshToken
+	err = app.Store.modify(refreshTokensBucket, hash, &rt, func(found bool) error {
+		switch {
+		case !found:
+			return errInvalidRefreshToken
+		case rt.UsedAt != nil:
+			return errRefreshTokenReused
+		case now.After(rt.ExpiresAt):
+			return errRefreshTokenExpired
+		case fromCookie && subtle.ConstantTimeCompare([]byte(hashSecret(r.Header.Get(csrfHeader))), []byte(rt.CSRFHash)) != 1:
+			return errInvalidCSRFToken
+		}
+		rt.UsedAt = &now
+		return nil
+	})
+
+	// a replayed token means it leaked, end the whole family so the thief's copy dies too
+	if errors.Is(err, errRefreshTokenReused) {
+		app.audit(r, auditEvent{Type: auditRefresh, Status: http.StatusUnauthorized, Outcome: outcomeDenied,
+			Detail: map[string]string{"reason": "refresh token reuse", "session_id": rt.SessionID}})
+		if revokeErr := app.revokeSession(rt.SessionID, "refresh token reuse detected"); revokeErr != nil {
+			app.errorJSON(w, revokeErr, nil, http.StatusInternalServerError)
+			return
+		}
+		app.errorJSON(w, err, nil, http.StatusUnauthorized)
+		return
+	}
+	if errors.Is(err, errInvalidCSRFToken) {
+		app.errorJSON(w, err, nil, http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, errInvalidRefreshToken) || errors.Is(err, errRefreshTokenExpired) {
+		app.errorJSON(w, err, nil, http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+
+	var s session
+	err = app.Store.modify(sessionsBucket, rt.SessionID, &s, func(found bool) error {
+		if !found || s.RevokedAt != nil || account == nil || account.UserID != s.UserID {
+			return errSessionRevoked
+		}
+		s.Email = account.Email
+		s.Roles = account.Roles
+		s.LastUsedAt = now
+		s.LastIP = clientIP(r)
+		return nil
+	})
+	if errors.Is(err, errSessionRevoked) {
+		app.errorJSON(w, err, nil, http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+
+	tokens, err := app.issueTokens(w, s)
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+
+	var payload jsonResponse
+	payload.Error = false
+	payload.StatusCode = http.StatusOK
+	payload.Message = "tokens refreshed"
+	payload.Data = tokens
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
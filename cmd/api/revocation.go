@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const revokedTokensBucket = "revoked_tokens"
+
+// tokens without an exp are taken to live this long, no token is expected to outlive it
+const maxTokenLifetime = 30 * 24 * time.Hour
+
+// revokedToken is kept until the token would have expired anyway
+type revokedToken struct {
+	UserID    string    `json:"user_id"`
+	RevokedAt time.Time `json:"revoked_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// tokenID identifies a token on the revocation list by its jti, or by its hash when it has none
+func tokenID(token string) string {
+	claims := jwt.MapClaims{}
+	_, _, err := jwt.NewParser().ParseUnverified(token, claims)
+	if err == nil {
+		if jti, ok := claims["jti"].(string); ok && jti != "" {
+			return jti
+		}
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// tokenExpiry reads the exp claim of an already verified token
+func tokenExpiry(token string) time.Time {
+	claims := jwt.MapClaims{}
+	_, _, err := jwt.NewParser().ParseUnverified(token, claims)
+	if err == nil {
+		if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+			return exp.Time
+		}
+	}
+
+	// without an exp keep it long enough to outlive any session
+	return time.Now().Add(maxTokenLifetime)
+}
+
+// tokenIssuedAt reads the iat claim of an already verified token, the zero time when it has none
+func tokenIssuedAt(token string) time.Time {
+	claims := jwt.MapClaims{}
+	_, _, err := jwt.NewParser().ParseUnverified(token, claims)
+	if err == nil {
+		if iat, err := claims.GetIssuedAt(); err == nil && iat != nil {
+			return iat.Time
+		}
+	}
+	return time.Time{}
+}
+
+// revokeToken puts the token on the revocation list
+func (app *Config) revokeToken(token, userID string) error {
+	return app.Store.put(revokedTokensBucket, tokenID(token), revokedToken{
+		UserID:    userID,
+		RevokedAt: time.Now().UTC(),
+		ExpiresAt: tokenExpiry(token).UTC(),
+	})
+}
+
+func (app *Config) isTokenRevoked(token string) (bool, error) {
+	var revoked revokedToken
+	return app.Store.get(revokedTokensBucket, tokenID(token), &revoked)
+}
+
+// purgeRevokedTokens drops entries for tokens that have expired since, and force logouts older than
+// any token they refuse, on every tick
+func (app *Config) purgeRevokedTokens(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var expired []string
+		now := time.Now()
+		err := app.Store.each(revokedTokensBucket, func(key string, value []byte) error {
+			var revoked revokedToken
+			if err := json.Unmarshal(value, &revoked); err == nil && now.After(revoked.ExpiresAt) {
+				expired = append(expired, key)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Println("error reading revoked tokens", err)
+			continue
+		}
+
+		for _, key := range expired {
+			if err := app.Store.delete(revokedTokensBucket, key); err != nil {
+				log.Println("error purging revoked token", err)
+			}
+		}
+
+		//a force logout only has tokens to refuse until the last of them has expired
+		lifetime := maxTokenLifetime
+		if app.Tokens != nil && app.Tokens.AccessTTL > lifetime {
+			lifetime = app.Tokens.AccessTTL
+		}
+		var outlived []string
+		err = app.Store.each(revokedUsersBucket, func(key string, value []byte) error {
+			var revocation userRevocation
+			if err := json.Unmarshal(value, &revocation); err == nil && now.After(revocation.RevokedBefore.Add(lifetime)) {
+				outlived = append(outlived, key)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Println("error reading revoked users", err)
+			continue
+		}
+
+		for _, key := range outlived {
+			if err := app.Store.delete(revokedUsersBucket, key); err != nil {
+				log.Println("error purging revoked user", err)
+			}
+		}
+	}
+}
@@ -5,47 +5,133 @@ import (
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
-	"github.com/go-chi/cors"
 )
 
 /* returns http.Handler*/
 func (app *Config) routes() http.Handler {
 	mux := chi.NewRouter()
 
-	//specify who is allowed to connect
-	mux.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   []string{"https://*", "http://*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
-		AllowCredentials: true,
-		MaxAge:           300,
-	}))
+	//answer in the language of the client, harden every response and refuse methods no route uses
+	mux.Use(app.negotiateLanguage, app.securityHeaders, app.rejectUnexpectedMethods)
+	mux.MethodNotAllowed(app.methodNotAllowed)
+	mux.NotFound(app.notFound)
+
+	//specify who is allowed to connect, per route group
+	mux.Use(app.CORS.handler)
 
 	mux.Use(middleware.Heartbeat("/ping"))
-	mux.Post("/api/v1/authentication/signup", app.Signup)
-	mux.Post("/api/v1/authentication/login", app.Login)
-	mux.Get("/api/v1/authentication/all-users", app.GetAllUsers)
 
-	//POS Mainnet & Testnet: Missed Checkpoint
-	mux.Get("/api/v1/pos/mainnet/mainnet-missed-checkpoint", app.MainnetMissedCheckpoint)
-	mux.Get("/api/v1/pos/testnet/testnet-missed-checkpoint", app.TestnetMissedCheckpoint)
+	//anonymous clients are limited by ip
+	mux.Group(func(mux chi.Router) {
+		mux.Use(app.rateLimit("auth"))
+
+		mux.Post("/api/v1/authentication/signup", app.Signup)
+		mux.Post("/api/v1/authentication/login", app.Login)
+		mux.Post("/api/v1/authentication/refresh", app.Refresh)
+		mux.Post("/api/v1/authentication/2fa/enroll", app.EnrollTwoFactorLogin)
+		mux.Post("/api/v1/authentication/2fa/verify", app.VerifyTwoFactorLogin)
+		mux.Post("/api/v1/authentication/siwe/nonce", app.SIWENonce)
+		mux.Post("/api/v1/authentication/siwe/verify", app.SIWEVerify)
+	})
+
+	//everything below requires an authenticated principal. Every address is limited before its
+	//credentials are checked, which may take a call to the auth service
+	mux.Group(func(mux chi.Router) {
+		mux.Use(app.rateLimit("ip"), app.authenticate, app.auditRequests, app.rateLimit("default"), app.meter)
+
+		mux.Get("/api/v1/authentication/get-me", app.GetMe)
+		mux.Get("/api/v1/authentication/verify-token", app.VerifyToken)
+		mux.Post("/api/v1/authentication/log-out", app.Logout)
+		mux.With(app.requirePermission(permUsersRead)).Get("/api/v1/authentication/all-users", app.GetAllUsers)
+
+		//API keys for machine clients
+		mux.Post("/api/v1/api-keys", app.CreateAPIKey)
+		mux.Get("/api/v1/api-keys", app.ListAPIKeys)
+		mux.Post("/api/v1/api-keys/{id}/rotate", app.RotateAPIKey)
+		mux.Delete("/api/v1/api-keys/{id}", app.RevokeAPIKey)
+
+		//sessions of the principal, admins can sign anyone out
+		mux.Get("/api/v1/sessions", app.ListSessions)
+		mux.Delete("/api/v1/sessions", app.RevokeOtherSessions)
+		mux.Delete("/api/v1/sessions/{id}", app.RevokeSession)
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.requirePermission(permSessionsManage))
+
+			mux.Get("/api/v1/admin/users/{userID}/sessions", app.ListUserSessions)
+			mux.Delete("/api/v1/admin/users/{userID}/sessions", app.ForceLogout)
+		})
+
+		//two-factor authentication of the principal, admins reset it for users who lost their device
+		mux.Get("/api/v1/2fa", app.TwoFactorStatus)
+		mux.Post("/api/v1/2fa/enroll", app.EnrollTwoFactor)
+		mux.Post("/api/v1/2fa/activate", app.ActivateTwoFactor)
+		mux.Post("/api/v1/2fa/disable", app.DisableTwoFactor)
+		mux.Post("/api/v1/2fa/recovery-codes", app.RegenerateRecoveryCodes)
+		mux.With(app.requirePermission(permSecurityManage)).Delete("/api/v1/admin/users/{userID}/2fa", app.ResetTwoFactor)
+
+		//wallets that log in to the account of the principal with sign-in with ethereum
+		mux.Get("/api/v1/wallets", app.ListWallets)
+		mux.Post("/api/v1/wallets", app.LinkWallet)
+		mux.Delete("/api/v1/wallets/{address}", app.UnlinkWallet)
+
+		//usage of the principal, and of everyone for admins
+		mux.Get("/api/v1/usage", app.GetUsage)
+		mux.With(app.requirePermission(permUsageRead)).Get("/api/v1/admin/usage", app.ExportUsage)
+
+		//audit log
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.requirePermission(permAuditRead))
+
+			mux.Get("/api/v1/admin/audit", app.QueryAudit)
+			mux.Get("/api/v1/admin/audit/export", app.ExportAudit)
+			mux.Get("/api/v1/admin/audit/verify", app.VerifyAudit)
+		})
+
+		//login lockouts and security events
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.requirePermission(permSecurityManage))
+
+			mux.Get("/api/v1/admin/lockouts", app.ListLockouts)
+			mux.Delete("/api/v1/admin/lockouts", app.ClearLockout)
+			mux.Get("/api/v1/admin/security-events", app.SecurityEvents)
+		})
+
+		//POS upstream nodes and their health
+		mux.With(app.requirePermission(permUpstreamsRead)).Get("/api/v1/pos/upstreams", app.UpstreamStatus)
+
+		//POS routes, some networks may be restricted to certain roles
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.requirePermission(permPOSRead), app.restrictNetwork, app.rateLimit("pos"))
+
+			//POS Mainnet & Testnet: Missed Checkpoint
+			mux.Get("/api/v1/pos/mainnet/mainnet-missed-checkpoint", app.MainnetMissedCheckpoint)
+			mux.Get("/api/v1/pos/testnet/testnet-missed-checkpoint", app.TestnetMissedCheckpoint)
+
+			//POS Mainnet &Testnet: Heimdall Block Height
+			mux.Get("/api/v1/pos/mainnet/heimdal-block-height", app.MainnetHeimdalBlockHeight)
+			mux.Get("/api/v1/pos/testnet/heimdal-block-height", app.TestnetHeimdalBlockHeight)
+
+			//POS Mainnet &Testnet: Bor Latest Block Detail
+			mux.Get("/api/v1/pos/mainnet/bor-latest-block-details", app.MainnetBorLatestBlockDetails)
+			mux.Get("/api/v1/pos/testnet/bor-latest-block-details", app.TestnetBorLatestBlockDetails)
 
-	//POS Mainnet &Testnet: Heimdall Block Height
-	mux.Get("/api/v1/pos/mainnet/heimdal-block-height", app.MainnetHeimdalBlockHeight)
-	mux.Get("/api/v1/pos/testnet/heimdal-block-height", app.TestnetHeimdalBlockHeight)
+			//POS Mainnet &Testnet: State Sync
+			mux.Get("/api/v1/pos/mainnet/state-sync", app.MainnetStateSync)
+			mux.Get("/api/v1/pos/testnet/state-sync", app.TestnetStateSync)
 
-	//POS Mainnet &Testnet: Bor Latest Block Detail
-	mux.Get("/api/v1/pos/mainnet/bor-latest-block-details", app.MainnetBorLatestBlockDetails)
-	mux.Get("/api/v1/pos/testnet/bor-latest-block-details", app.TestnetBorLatestBlockDetails)
+			//POS Mainnet & Testnet: Checkpoint inclusion of a bor block or transaction
+			mux.Get("/api/v1/pos/{network}/checkpoints/inclusion", app.CheckpointInclusion)
+			mux.Get("/api/v1/pos/{network}/checkpoints/proof", app.CheckpointProof)
 
-	//POS Mainnet &Testnet: State Sync
-	mux.Get("/api/v1/pos/mainnet/state-sync", app.MainnetStateSync)
-	mux.Get("/api/v1/pos/testnet/state-sync", app.TestnetStateSync)
+			//POS Mainnet & Testnet: Bridge deposit tracker
+			mux.With(app.requirePermission(permBridgeTrack)).Post("/api/v1/pos/{network}/bridge/deposits", app.TrackDeposit)
+			mux.Get("/api/v1/pos/{network}/bridge/deposits/{txHash}", app.GetDeposit)
 
-	// mux.Get("/api/v1/authentication/get-me", app.GetMe)
-	// mux.Get("/api/v1/authentication/verify-token", app.VerifyToken)
-	// mux.Post("/api/v1/authentication/log-out", app.Logout)
+			//POS Mainnet & Testnet: Bridge withdrawal/exit tracker
+			mux.With(app.requirePermission(permBridgeTrack)).Post("/api/v1/pos/{network}/bridge/withdrawals", app.TrackWithdrawal)
+			mux.Get("/api/v1/pos/{network}/bridge/withdrawals/{txHash}", app.GetWithdrawal)
+		})
+	})
 
 	return mux
 }
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// chainClient is shared by every call the broker makes directly to heimdall, bor or ethereum
+var chainClient = &http.Client{Timeout: 15 * time.Second}
+
+type rpcRequest struct {
+	JSONRPC string `json:"jsonrpc"`
+	ID      int    `json:"id"`
+	Method  string `json:"method"`
+	Params  []any  `json:"params"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type rpcResponse struct {
+	ID     int             `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *rpcError       `json:"error"`
+}
+
+// rpcCall performs a single json-rpc call and decodes the result into result
+func rpcCall(ctx context.Context, url, method string, params []any, result any) error {
+	if url == "" {
+		return fmt.Errorf("no rpc endpoint configured for %s", method)
+	}
+
+	body, err := json.Marshal(rpcRequest{JSONRPC: "2.0", ID: 1, Method: method, Params: params})
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := chainClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", method, response.StatusCode)
+	}
+
+	var rpcResult rpcResponse
+	err = json.NewDecoder(response.Body).Decode(&rpcResult)
+	if err != nil {
+		return err
+	}
+
+	if rpcResult.Error != nil {
+		return fmt.Errorf("%s: %s", method, rpcResult.Error.Message)
+	}
+
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(rpcResult.Result, result)
+}
+
+// rpcBatch sends the calls as one json-rpc batch and returns the raw results in request order
+func rpcBatch(ctx context.Context, url string, calls []rpcRequest) ([]json.RawMessage, error) {
+	if url == "" {
+		return nil, errors.New("no rpc endpoint configured")
+	}
+	for i := range calls {
+		calls[i].JSONRPC = "2.0"
+		calls[i].ID = i
+	}
+
+	body, err := json.Marshal(calls)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := chainClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("rpc batch returned status %d", response.StatusCode)
+	}
+
+	var rpcResults []rpcResponse
+	err = json.NewDecoder(response.Body).Decode(&rpcResults)
+	if err != nil {
+		return nil, err
+	}
+
+	// batch responses may come back in any order
+	results := make([]json.RawMessage, len(calls))
+	for _, rpcResult := range rpcResults {
+		if rpcResult.ID < 0 || rpcResult.ID >= len(calls) {
+			return nil, fmt.Errorf("unexpected rpc batch id %d", rpcResult.ID)
+		}
+		if rpcResult.Error != nil {
+			return nil, fmt.Errorf("%s: %s", calls[rpcResult.ID].Method, rpcResult.Error.Message)
+		}
+		results[rpcResult.ID] = rpcResult.Result
+	}
+	for i, result := range results {
+		if result == nil {
+			return nil, fmt.Errorf("missing rpc batch result for %s", calls[i].Method)
+		}
+	}
+
+	return results, nil
+}
+
+// ethCall runs eth_call against the latest block and returns the raw return data
+func ethCall(ctx context.Context, url, to, data string) ([]byte, error) {
+	var out string
+	call := map[string]string{"to": to, "data": data}
+	err := rpcCall(ctx, url, "eth_call", []any{call, "latest"}, &out)
+	if err != nil {
+		return nil, err
+	}
+	return decodeHex(out)
+}
+
+// hexUint64 parses a 0x prefixed quantity such as a block number
+func hexUint64(s string) (uint64, error) {
+	if s == "" {
+		return 0, errors.New("empty hex quantity")
+	}
+	return strconv.ParseUint(strings.TrimPrefix(s, "0x"), 16, 64)
+}
+
+func decodeHex(s string) ([]byte, error) {
+	s = strings.TrimPrefix(s, "0x")
+	if len(s)%2 == 1 {
+		s = "0" + s
+	}
+	return hex.DecodeString(s)
+}
+
+// abiWord returns the 32 byte abi word at index i of data
+func abiWord(data []byte, i int) []byte {
+	if len(data) < (i+1)*32 {
+		return make([]byte, 32)
+	}
+	return data[i*32 : (i+1)*32]
+}
+
+// abiUint encodes n as a hex abi word without the 0x prefix
+func abiUint(n uint64) string {
+	return fmt.Sprintf("%064x", n)
+}
+
+func wordToUint64(word []byte) uint64 {
+	return new(big.Int).SetBytes(word).Uint64()
+}
+
+func wordToAddress(word []byte) string {
+	return "0x" + hex.EncodeToString(word[12:])
+}
+
+// normalizeTxHash lowercases a transaction hash and gives it the 0x prefix it may have been sent without
+func normalizeTxHash(s string) string {
+	return "0x" + strings.TrimPrefix(strings.ToLower(s), "0x")
+}
+
+func isTxHash(s string) bool {
+	s = strings.TrimPrefix(s, "0x")
+	if len(s) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
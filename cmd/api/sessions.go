@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// the last use of a session is written at most this often, busy clients would write on every request
+const sessionTouchInterval = time.Minute
+
+const revokedUsersBucket = "revoked_users"
+
+// userRevocation is left by a force logout, every token issued to the user up to RevokedBefore is
+// refused whoever issued it, tokens of the auth service included. It is purged once those tokens
+// would have expired anyway
+type userRevocation struct {
+	UserID        string    `json:"user_id"`
+	RevokedBefore time.Time `json:"revoked_before"`
+	Reason        string    `json:"reason"`
+}
+
+// sessionView is a session as its owner sees it, Current marks the one the request came from
+type sessionView struct {
+	session
+	Current bool `json:"current"`
+}
+
+// sessionID returns the session a broker issued token belongs to, tokens of the auth service have none
+func (app *Config) sessionID(principal *Principal) string {
+	if app.Tokens == nil || principal.APIKeyID != "" || !app.Tokens.issued(principal.Token) {
+		return ""
+	}
+	id, _ := principal.Claims["sid"].(string)
+	return id
+}
+
+// touchSession fails with errSessionRevoked once the session was revoked or has expired, so its
+// access tokens stop working right away, and otherwise records where and when it was last used
+func (app *Config) touchSession(id, ip string) error {
+	var s session
+	found, err := app.Store.get(sessionsBucket, id, &s)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	if !found || s.RevokedAt != nil || now.After(s.ExpiresAt) {
+		return errSessionRevoked
+	}
+	if now.Sub(s.LastUsedAt) < sessionTouchInterval && s.LastIP == ip {
+		return nil
+	}
+
+	return app.Store.modify(sessionsBucket, id, &s, func(found bool) error {
+		if !found || s.RevokedAt != nil {
+			return errSessionRevoked
+		}
+		s.LastUsedAt = now
+		s.LastIP = ip
+		return nil
+	})
+}
+
+// userSessions returns the sessions of a user, newest first. Revoked and expired ones only when all is set
+func (app *Config) userSessions(userID string, all bool) ([]session, error) {
+	now := time.Now().UTC()
+	sessions := []session{}
+	err := app.Store.each(sessionsBucket, func(_ string, value []byte) error {
+		var s session
+		if err := json.Unmarshal(value, &s); err != nil {
+			return err
+		}
+		if s.UserID == userID && (all || (s.RevokedAt == nil && now.Before(s.ExpiresAt))) {
+			sessions = append(sessions, s)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].CreatedAt.After(sessions[j].CreatedAt) })
+	return sessions, nil
+}
+
+// revokeUserSessions ends every active session of the user but except, returning the ids it revoked
+func (app *Config) revokeUserSessions(userID, except, reason string) ([]string, error) {
+	sessions, err := app.userSessions(userID, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// each runs in a read transaction, so the sessions are revoked after it is done
+	revoked := []string{}
+	for _, s := range sessions {
+		if s.ID == except {
+			continue
+		}
+		if err := app.revokeSession(s.ID, reason); err != nil {
+			return revoked, err
+		}
+		revoked = append(revoked, s.ID)
+	}
+	return revoked, nil
+}
+
+// revokeUserTokens refuses every token the user holds now. iat only has seconds, so tokens issued in
+// the same second are refused as well
+func (app *Config) revokeUserTokens(userID, reason string) error {
+	return app.Store.put(revokedUsersBucket, userID, userRevocation{
+		UserID:        userID,
+		RevokedBefore: time.Now().UTC().Truncate(time.Second),
+		Reason:        reason,
+	})
+}
+
+// revokedByForceLogout reports whether the token of the principal was issued before its user was
+// logged out everywhere. Tokens without an iat can't show they are newer and are refused
+func (app *Config) revokedByForceLogout(principal *Principal) (bool, error) {
+	var revocation userRevocation
+	found, err := app.Store.get(revokedUsersBucket, principal.UserID, &revocation)
+	if err != nil || !found {
+		return false, err
+	}
+	issuedAt := tokenIssuedAt(principal.Token)
+	return !issuedAt.After(revocation.RevokedBefore), nil
+}
+
+// revokeUserAPIKeys revokes every active api key of the user, returning the ids it revoked
+func (app *Config) revokeUserAPIKeys(userID string) ([]string, error) {
+	now := time.Now().UTC()
+	var ids []string
+	err := app.Store.each(apiKeysBucket, func(_ string, value []byte) error {
+		var key apiKey
+		if err := json.Unmarshal(value, &key); err != nil {
+			return err
+		}
+		if key.UserID == userID && key.active(now) {
+			ids = append(ids, key.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// each runs in a read transaction, so the keys are revoked after it is done
+	revoked := []string{}
+	for _, id := range ids {
+		var key apiKey
+		err := app.Store.modify(apiKeysBucket, id, &key, func(found bool) error {
+			if !found {
+				return errAPIKeyNotFound
+			}
+			if key.RevokedAt == nil {
+				key.RevokedAt = &now
+			}
+			return nil
+		})
+		if errors.Is(err, errAPIKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return revoked, err
+		}
+		revoked = append(revoked, id)
+	}
+	return revoked, nil
+}
+
+// sessionOwner returns the principal when it may manage its sessions, api keys have none
+func (app *Config) sessionOwner(w http.ResponseWriter, r *http.Request) (*Principal, bool) {
+	principal, ok := principalFrom(r.Context())
+	if !ok {
+		app.errorJSON(w, newCodedError("auth.unauthorized"), nil, http.StatusUnauthorized)
+		return nil, false
+	}
+	if principal.APIKeyID != "" {
+		app.errorJSON(w, errors.New("sessions can only be managed with a bearer token"), nil, http.StatusForbidden)
+		return nil, false
+	}
+	return principal, true
+}
+
+// describeDevice turns a user agent into something a person recognizes, like Chrome on Windows
+func describeDevice(userAgent string) string {
+	if userAgent == "" {
+		return "unknown device"
+	}
+
+	client := ""
+	for _, known := range []struct{ token, name string }{
+		{"Edg/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"}, {"Chrome/", "Chrome"}, {"Safari/", "Safari"},
+		{"curl/", "curl"}, {"PostmanRuntime/", "Postman"}, {"okhttp/", "OkHttp"}, {"Go-http-client/", "Go"},
+	} {
+		if strings.Contains(userAgent, known.token) {
+			client = known.name
+			break
+		}
+	}
+
+	platform := ""
+	for _, known := range []struct{ token, name string }{
+		{"iPhone", "iOS"}, {"iPad", "iPadOS"}, {"Android", "Android"}, {"Windows", "Windows"},
+		{"Mac OS X", "macOS"}, {"CrOS", "ChromeOS"}, {"Linux", "Linux"},
+	} {
+		if strings.Contains(userAgent, known.token) {
+			platform = known.name
+			break
+		}
+	}
+
+	switch {
+	case client != "" && platform != "":
+		return client + " on " + platform
+	case client != "":
+		return client
+	case platform != "":
+		return platform
+	}
+	// unknown clients are still better shown by their product name than not at all
+	product, _, _ := strings.Cut(userAgent, " ")
+	product, _, _ = strings.Cut(product, "/")
+	return product
+}
+
+func (app *Config) ListSessions(w http.ResponseWriter, r *http.Request) {
+	principal, ok := app.sessionOwner(w, r)
+	if !ok {
+		return
+	}
+
+	all, _ := strconv.ParseBool(r.URL.Query().Get("all"))
+	sessions, err := app.userSessions(principal.UserID, all)
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+
+	current := app.sessionID(principal)
+	views := make([]sessionView, len(sessions))
+	for i, s := range sessions {
+		views[i] = sessionView{session: s, Current: s.ID == current}
+	}
+
+	var payload jsonResponse
+	payload.Error = false
+	payload.StatusCode = http.StatusOK
+	payload.Message = "sessions"
+	payload.Data = views
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+func (app *Config) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	principal, ok := app.sessionOwner(w, r)
+	if !ok {
+		return
+	}
+
+	var s session
+	found, err := app.Store.get(sessionsBucket, chi.URLParam(r, "id"), &s)
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+	if !found || s.UserID != principal.UserID {
+		app.errorJSON(w, errSessionNotFound, nil, http.StatusNotFound)
+		return
+	}
+
+	if s.RevokedAt == nil {
+		reason := "revoked by the user"
+		if s.ID == app.sessionID(principal) {
+			reason = "logged out"
+		}
+		if err := app.revokeSession(s.ID, reason); err != nil {
+			app.errorJSON(w, err, nil, http.StatusInternalServerError)
+			return
+		}
+		app.audit(r, auditEvent{Type: "session.revoked", Outcome: outcomeSuccess, Detail: map[string]string{"session_id": s.ID}})
+	}
+
+	var payload jsonResponse
+	payload.Error = false
+	payload.StatusCode = http.StatusOK
+	payload.Message = "session revoked"
+	payload.Data = map[string]string{"session_id": s.ID}
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+// RevokeOtherSessions signs the user out everywhere but the device making the request
+func (app *Config) RevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	principal, ok := app.sessionOwner(w, r)
+	if !ok {
+		return
+	}
+
+	current := app.sessionID(principal)
+	revoked, err := app.revokeUserSessions(principal.UserID, current, "revoked by the user from another session")
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+
+	app.audit(r, auditEvent{Type: "session.revoked_others", Outcome: outcomeSuccess,
+		Detail: map[string]string{"count": strconv.Itoa(len(revoked)), "kept_session_id": current}})
+
+	var payload jsonResponse
+	payload.Error = false
+	payload.StatusCode = http.StatusOK
+	payload.Message = "other sessions revoked"
+	payload.Data = map[string]any{"revoked": revoked, "current_session_id": current}
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+func (app *Config) ListUserSessions(w http.ResponseWriter, r *http.Request) {
+	all, _ := strconv.ParseBool(r.URL.Query().Get("all"))
+	sessions, err := app.userSessions(chi.URLParam(r, "userID"), all)
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+
+	var payload jsonResponse
+	payload.Error = false
+	payload.StatusCode = http.StatusOK
+	payload.Message = "sessions"
+	payload.Data = sessions
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+// ForceLogout revokes every session and api key of a user, and every token issued to them so far
+// whether by the broker or the auth service. All of it stops working on the next request
+func (app *Config) ForceLogout(w http.ResponseWriter, r *http.Request) {
+	userID := chi.URLParam(r, "userID")
+	err := app.revokeUserTokens(userID, "revoked by an administrator")
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+
+	revoked, err := app.revokeUserSessions(userID, "", "revoked by an administrator")
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+
+	keys, err := app.revokeUserAPIKeys(userID)
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+
+	app.audit(r, auditEvent{Type: "admin.force_logout", Outcome: outcomeSuccess,
+		Detail: map[string]string{"user_id": userID, "count": strconv.Itoa(len(revoked)), "api_keys": strconv.Itoa(len(keys))}})
+
+	var payload jsonResponse
+	payload.Error = false
+	payload.StatusCode = http.StatusOK
+	payload.Message = "user logged out of every session"
+	payload.Data = map[string]any{"user_id": userID, "revoked": revoked, "revoked_api_keys": keys}
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
@@ -0,0 +1,646 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+	"github.com/go-chi/chi/v5"
+)
+
+// Sign-In With Ethereum, EIP-4361. Wallets sign a plain text message naming the broker, a chain and
+// a nonce the broker handed out; the address recovered from the signature logs in to the account it
+// was linked to. Only externally owned accounts are supported, contract wallets (EIP-1271) would need
+// an rpc call per login
+const (
+	siweNoncesBucket = "siwe_nonces"
+	walletsBucket    = "wallets"
+	siweHeader       = " wants you to sign in with your Ethereum account:"
+)
+
+var (
+	errInvalidSIWEMessage   = errors.New("invalid sign-in with ethereum message")
+	errInvalidSIWESignature = newCodedError("siwe.invalid_signature")
+	errInvalidSIWENonce     = newCodedError("siwe.invalid_nonce")
+	errWalletNotLinked      = newCodedError("siwe.wallet_not_linked")
+	errWalletLinked         = errors.New("wallet is already linked to an account")
+)
+
+// siweConfig holds the Sign-In With Ethereum settings that come from the environment. Messages must
+// name SIWE_DOMAIN, the host of the request is up to the client and can't stand in for it
+type siweConfig struct {
+	Domain   string
+	ChainIDs map[int64]bool
+	NonceTTL time.Duration
+	Skew     time.Duration
+}
+
+// siweMessage is a parsed EIP-4361 message, optional fields are zero when absent
+type siweMessage struct {
+	Domain         string
+	Address        string
+	Statement      string
+	URI            string
+	Version        string
+	ChainID        int64
+	Nonce          string
+	IssuedAt       time.Time
+	ExpirationTime *time.Time
+	NotBefore      *time.Time
+	RequestID      string
+	Resources      []string
+}
+
+// siweNonce is stored until it was used once or expired
+type siweNonce struct {
+	IssuedAt  time.Time  `json:"issued_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+}
+
+// walletLink ties a wallet address to an account, keyed by the lowercase address. The roles are
+// those of the account when it last logged in, wallet logins look them up again at the auth service
+type walletLink struct {
+	Address     string     `json:"address"`
+	UserID      string     `json:"user_id"`
+	Email       string     `json:"email"`
+	Roles       []string   `json:"roles,omitempty"`
+	LinkedAt    time.Time  `json:"linked_at"`
+	LastLoginAt *time.Time `json:"last_login_at,omitempty"`
+}
+
+type SIWEPayload struct {
+	Message   string `json:"message" validate:"required,max=4096"`
+	Signature string `json:"signature" validate:"required,regex=^0x[0-9a-fA-F]{130}$"`
+}
+
+// loadSIWEConfig returns nil when SIWE_DOMAIN is unset, which turns sign-in with ethereum off
+func loadSIWEConfig() *siweConfig {
+	domain := strings.TrimSpace(os.Getenv("SIWE_DOMAIN"))
+	if domain == "" {
+		return nil
+	}
+
+	config := &siweConfig{
+		Domain:   domain,
+		ChainIDs: map[int64]bool{},
+		NonceTTL: envDuration("SIWE_NONCE_TTL", 5*time.Minute),
+		Skew:     envDuration("SIWE_CLOCK_SKEW", time.Minute),
+	}
+
+	// ethereum, polygon and the amoy testnet unless told otherwise
+	for _, id := range strings.Split(envOr("SIWE_CHAIN_IDS", "1,137,80002"), ",") {
+		chainID, err := strconv.ParseInt(strings.TrimSpace(id), 10, 64)
+		if err != nil {
+			log.Panicf("SIWE_CHAIN_IDS: %q is not a chain id", id)
+		}
+		config.ChainIDs[chainID] = true
+	}
+	return config
+}
+
+// parseSIWEMessage reads the fields of an EIP-4361 message in the order the spec gives them
+func parseSIWEMessage(text string) (*siweMessage, error) {
+	invalid := func(format string, args ...any) error {
+		return fmt.Errorf("%w: %s", errInvalidSIWEMessage, fmt.Sprintf(format, args...))
+	}
+
+	lines := strings.Split(text, "\n")
+	if len(lines) < 2 || !strings.HasSuffix(lines[0], siweHeader) {
+		return nil, invalid("must start with <domain>%s", siweHeader)
+	}
+	message := &siweMessage{Domain: strings.TrimSuffix(lines[0], siweHeader), Address: lines[1]}
+	if message.Domain == "" {
+		return nil, invalid("domain is missing")
+	}
+	if !isChecksumAddress(message.Address) {
+		return nil, invalid("address must be an EIP-55 checksummed address")
+	}
+
+	// the statement is whatever stands between the address and the URI
+	i := 2
+	var statement []string
+	for ; i < len(lines) && !strings.HasPrefix(lines[i], "URI: "); i++ {
+		if lines[i] != "" {
+			statement = append(statement, lines[i])
+		}
+	}
+	message.Statement = strings.Join(statement, "\n")
+
+	field := func(name string, required bool) (string, bool, error) {
+		if i < len(lines) && strings.HasPrefix(lines[i], name+": ") {
+			value := strings.TrimPrefix(lines[i], name+": ")
+			i++
+			return value, true, nil
+		}
+		if required {
+			return "", false, invalid("%s is missing", name)
+		}
+		return "", false, nil
+	}
+	timestamp := func(name string, required bool) (*time.Time, error) {
+		value, ok, err := field(name, required)
+		if err != nil || !ok {
+			return nil, err
+		}
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return nil, invalid("%s must be an RFC 3339 timestamp", name)
+		}
+		return &t, nil
+	}
+
+	var err error
+	if message.URI, _, err = field("URI", true); err != nil {
+		return nil, err
+	}
+	if u, err := url.Parse(message.URI); err != nil || u.Scheme == "" {
+		return nil, invalid("URI must be an absolute uri")
+	}
+	if message.Version, _, err = field("Version", true); err != nil {
+		return nil, err
+	}
+	if message.Version != "1" {
+		return nil, invalid("only version 1 is supported")
+	}
+	chainID, _, err := field("Chain ID", true)
+	if err != nil {
+		return nil, err
+	}
+	if message.ChainID, err = strconv.ParseInt(chainID, 10, 64); err != nil {
+		return nil, invalid("Chain ID must be a number")
+	}
+	if message.Nonce, _, err = field("Nonce", true); err != nil {
+		return nil, err
+	}
+	issuedAt, err := timestamp("Issued At", true)
+	if err != nil {
+		return nil, err
+	}
+	message.IssuedAt = *issuedAt
+	if message.ExpirationTime, err = timestamp("Expiration Time", false); err != nil {
+		return nil, err
+	}
+	if message.NotBefore, err = timestamp("Not Before", false); err != nil {
+		return nil, err
+	}
+	if message.RequestID, _, err = field("Request ID", false); err != nil {
+		return nil, err
+	}
+	if i < len(lines) && lines[i] == "Resources:" {
+		for i++; i < len(lines) && strings.HasPrefix(lines[i], "- "); i++ {
+			message.Resources = append(message.Resources, strings.TrimPrefix(lines[i], "- "))
+		}
+	}
+
+	// a trailing newline is all that may follow
+	for ; i < len(lines); i++ {
+		if lines[i] != "" {
+			return nil, invalid("unexpected line %q", lines[i])
+		}
+	}
+	return message, nil
+}
+
+// checksumAddress writes a 20 byte address in EIP-55 mixed case
+func checksumAddress(address []byte) string {
+	lower := hex.EncodeToString(address)
+	hash := hex.EncodeToString(keccak256([]byte(lower)))
+
+	checksummed := []byte(lower)
+	for i, c := range checksummed {
+		if c >= 'a' && c <= 'f' && hash[i] >= '8' {
+			checksummed[i] = c - 'a' + 'A'
+		}
+	}
+	return "0x" + string(checksummed)
+}
+
+func isChecksumAddress(address string) bool {
+	raw, err := hex.DecodeString(strings.TrimPrefix(address, "0x"))
+	return err == nil && strings.HasPrefix(address, "0x") && len(raw) == 20 && checksumAddress(raw) == address
+}
+
+// recoverSIWESigner returns the address whose key made the personal_sign (EIP-191) signature of text
+func recoverSIWESigner(text, signature string) (string, error) {
+	sig, err := hex.DecodeString(strings.TrimPrefix(signature, "0x"))
+	if err != nil || len(sig) != 65 {
+		return "", errInvalidSIWESignature
+	}
+
+	// wallets put the recovery id last as 27 or 28, some as 0 or 1; the compact format wants it first
+	v := sig[64]
+	if v >= 27 {
+		v -= 27
+	}
+	if v > 1 {
+		return "", errInvalidSIWESignature
+	}
+	compact := append([]byte{27 + v}, sig[:64]...)
+
+	hash := keccak256([]byte(fmt.Sprintf("\x19Ethereum Signed Message:\n%d%s", len(text), text)))
+	key, _, err := ecdsa.RecoverCompact(compact, hash)
+	if err != nil {
+		return "", errInvalidSIWESignature
+	}
+	return checksumAddress(keccak256(key.SerializeUncompressed()[1:])[12:]), nil
+}
+
+// verifySIWE checks a signed message against the domain, chains and clock of the broker and spends
+// its nonce, returning the address that signed it
+func (app *Config) verifySIWE(text, signature string) (string, error) {
+	message, err := parseSIWEMessage(text)
+	if err != nil {
+		return "", err
+	}
+
+	domain := app.SIWE.Domain
+	// newer wallets put the scheme in front of the domain
+	if _, host, ok := strings.Cut(message.Domain, "://"); ok {
+		message.Domain = host
+	}
+	if !strings.EqualFold(message.Domain, domain) {
+		return "", fmt.Errorf("%w: the message is for %s, not %s", errInvalidSIWEMessage, message.Domain, domain)
+	}
+	// the uri the wallet signed in to has to be on the domain too, parseSIWEMessage made sure it parses
+	if uri, _ := url.Parse(message.URI); !strings.EqualFold(uri.Host, domain) && !strings.EqualFold(uri.Hostname(), domain) {
+		return "", fmt.Errorf("%w: the URI %s is not on %s", errInvalidSIWEMessage, message.URI, domain)
+	}
+	if !app.SIWE.ChainIDs[message.ChainID] {
+		return "", fmt.Errorf("%w: chain %d is not accepted", errInvalidSIWEMessage, message.ChainID)
+	}
+
+	now := time.Now().UTC()
+	switch {
+	case message.IssuedAt.After(now.Add(app.SIWE.Skew)):
+		return "", fmt.Errorf("%w: Issued At is in the future", errInvalidSIWEMessage)
+	case message.ExpirationTime != nil && now.After(message.ExpirationTime.Add(app.SIWE.Skew)):
+		return "", fmt.Errorf("%w: the message has expired", errInvalidSIWEMessage)
+	case message.NotBefore != nil && now.Add(app.SIWE.Skew).Before(*message.NotBefore):
+		return "", fmt.Errorf("%w: the message is not valid yet", errInvalidSIWEMessage)
+	}
+
+	signer, err := recoverSIWESigner(text, signature)
+	if err != nil {
+		return "", err
+	}
+	if signer != message.Address {
+		return "", errInvalidSIWESignature
+	}
+
+	// only a correctly signed message spends the nonce, so nobody can burn the nonces of others
+	var nonce siweNonce
+	err = app.Store.modify(siweNoncesBucket, message.Nonce, &nonce, func(found bool) error {
+		if !found || nonce.UsedAt != nil || now.After(nonce.ExpiresAt) {
+			return errInvalidSIWENonce
+		}
+		nonce.UsedAt = &now
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return signer, nil
+}
+
+// walletOwner returns the principal when it may manage its wallets, api keys can't
+func (app *Config) walletOwner(w http.ResponseWriter, r *http.Request) (*Principal, bool) {
+	principal, ok := principalFrom(r.Context())
+	if !ok {
+		app.errorJSON(w, newCodedError("auth.unauthorized"), nil, http.StatusUnauthorized)
+		return nil, false
+	}
+	if principal.APIKeyID != "" {
+		app.errorJSON(w, errors.New("wallets can only be managed with a bearer token"), nil, http.StatusForbidden)
+		return nil, false
+	}
+	return principal, true
+}
+
+// siweEnabled answers with a 404 when SIWE_DOMAIN is unset
+func (app *Config) siweEnabled(w http.ResponseWriter) bool {
+	if app.SIWE == nil {
+		app.errorJSON(w, errors.New("sign-in with ethereum is not enabled, set SIWE_DOMAIN"), nil, http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// siweFailure answers a failed verification with the status that fits the error
+func (app *Config) siweFailure(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errInvalidSIWEMessage):
+		app.errorJSON(w, err, nil)
+	case errors.Is(err, errInvalidSIWESignature), errors.Is(err, errInvalidSIWENonce):
+		app.errorJSON(w, err, nil, http.StatusUnauthorized)
+	default:
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+	}
+}
+
+// syncWalletRoles copies the current roles of the principal to its wallets, so the wallets list the
+// roles of the last login
+func (app *Config) syncWalletRoles(principal *Principal) error {
+	var addresses []string
+	err := app.Store.each(walletsBucket, func(key string, value []byte) error {
+		var link walletLink
+		if err := json.Unmarshal(value, &link); err != nil {
+			return err
+		}
+		if link.UserID == principal.UserID && strings.Join(link.Roles, ",") != strings.Join(principal.Roles, ",") {
+			addresses = append(addresses, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, address := range addresses {
+		var link walletLink
+		err := app.Store.modify(walletsBucket, address, &link, func(found bool) error {
+			if !found || link.UserID != principal.UserID {
+				return errWalletNotLinked
+			}
+			link.Roles = principal.Roles
+			return nil
+		})
+		if err != nil && !errors.Is(err, errWalletNotLinked) {
+			return err
+		}
+	}
+	return nil
+}
+
+// purgeSIWENonces drops nonces that were used or expired, on every tick
+func (app *Config) purgeSIWENonces(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var stale []string
+		now := time.Now()
+		err := app.Store.each(siweNoncesBucket, func(key string, value []byte) error {
+			var nonce siweNonce
+			if err := json.Unmarshal(value, &nonce); err != nil || nonce.UsedAt != nil || now.After(nonce.ExpiresAt) {
+				stale = append(stale, key)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Println("error reading siwe nonces", err)
+			continue
+		}
+
+		for _, key := range stale {
+			if err := app.Store.delete(siweNoncesBucket, key); err != nil {
+				log.Println("error purging siwe nonces", err)
+			}
+		}
+	}
+}
+
+// SIWENonce hands out a nonce for the next message a wallet signs, to log in or to link the wallet
+func (app *Config) SIWENonce(w http.ResponseWriter, r *http.Request) {
+	if !app.siweEnabled(w) {
+		return
+	}
+
+	nonce, err := randomString(16)
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now().UTC()
+	err = app.Store.put(siweNoncesBucket, nonce, siweNonce{IssuedAt: now, ExpiresAt: now.Add(app.SIWE.NonceTTL)})
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+
+	chainIDs := make([]int64, 0, len(app.SIWE.ChainIDs))
+	for id := range app.SIWE.ChainIDs {
+		chainIDs = append(chainIDs, id)
+	}
+	sort.Slice(chainIDs, func(i, j int) bool { return chainIDs[i] < chainIDs[j] })
+
+	var payload jsonResponse
+	payload.Error = false
+	payload.StatusCode = http.StatusOK
+	payload.Message = "sign a message with this nonce"
+	payload.Data = map[string]any{
+		"nonce":      nonce,
+		"domain":     app.SIWE.Domain,
+		"chain_ids":  chainIDs,
+		"expires_in": int64(app.SIWE.NonceTTL.Seconds()),
+	}
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+// SIWEVerify logs in the account linked to the wallet that signed the message, through the same
+// two-factor check and session as a password login
+func (app *Config) SIWEVerify(w http.ResponseWriter, r *http.Request) {
+	if !app.siweEnabled(w) {
+		return
+	}
+	if app.Tokens == nil {
+		app.errorJSON(w, errors.New("sign-in with ethereum needs broker tokens, set BROKER_JWT_SECRET"), nil, http.StatusNotFound)
+		return
+	}
+
+	var requestPayload SIWEPayload
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, nil)
+		return
+	}
+
+	address, err := app.verifySIWE(requestPayload.Message, requestPayload.Signature)
+	if err != nil {
+		app.audit(r, auditEvent{Type: auditLogin, Status: http.StatusUnauthorized, Outcome: outcomeFailure,
+			Detail: map[string]string{"method": "siwe", "reason": err.Error()}})
+		app.siweFailure(w, err)
+		return
+	}
+
+	now := time.Now().UTC()
+	var link walletLink
+	err = app.Store.modify(walletsBucket, strings.ToLower(address), &link, func(found bool) error {
+		if !found {
+			return errWalletNotLinked
+		}
+		link.LastLoginAt = &now
+		return nil
+	})
+	if errors.Is(err, errWalletNotLinked) {
+		app.audit(r, auditEvent{Type: auditLogin, Status: http.StatusUnauthorized, Outcome: outcomeFailure,
+			Detail: map[string]string{"method": "siwe", "address": address, "reason": "wallet not linked"}})
+		app.errorJSON(w, err, map[string]string{"address": address}, http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+
+	// the link only says whose wallet it is, the account must still exist and brings its current roles.
+	// When the auth service can be asked, a login asks it every time rather than trust the cache
+	accounts.forget(link.UserID)
+	account, err := app.resolveAccount(r.Context(), &Principal{UserID: link.UserID, Email: link.Email, Roles: link.Roles})
+	if errors.Is(err, errAccountUnavailable) {
+		app.audit(r, auditEvent{Type: auditLogin, Actor: link.UserID, Email: link.Email, Status: http.StatusUnauthorized, Outcome: outcomeFailure,
+			Detail: map[string]string{"method": "siwe", "address": address, "reason": err.Error()}})
+		app.errorJSON(w, err, nil, http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusBadGateway)
+		return
+	}
+
+	// the same data the auth service returns on login, so the rest of the flow doesn't need to care
+	data := map[string]any{"user_id": account.UserID, "email": account.Email, "roles": account.Roles, "wallet": address}
+
+	if !app.guardLogin(w, r, account.Email) {
+		return
+	}
+	if app.TwoFactor != nil && app.challengeLogin(w, r, account.Email, data) {
+		return
+	}
+	app.completeLogin(w, r, account.Email, "logged in with ethereum", data)
+}
+
+// LinkWallet links the wallet that signed the message to the account of the principal
+func (app *Config) LinkWallet(w http.ResponseWriter, r *http.Request) {
+	if !app.siweEnabled(w) {
+		return
+	}
+	principal, ok := app.walletOwner(w, r)
+	if !ok {
+		return
+	}
+
+	var requestPayload SIWEPayload
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, nil)
+		return
+	}
+
+	address, err := app.verifySIWE(requestPayload.Message, requestPayload.Signature)
+	if err != nil {
+		app.siweFailure(w, err)
+		return
+	}
+
+	var link walletLink
+	err = app.Store.modify(walletsBucket, strings.ToLower(address), &link, func(found bool) error {
+		if found && link.UserID != principal.UserID {
+			return errWalletLinked
+		}
+		if !found {
+			link = walletLink{Address: address, UserID: principal.UserID, LinkedAt: time.Now().UTC()}
+		}
+		link.Email = principal.Email
+		link.Roles = principal.Roles
+		return nil
+	})
+	if errors.Is(err, errWalletLinked) {
+		app.errorJSON(w, err, nil, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+
+	app.audit(r, auditEvent{Type: "wallet.linked", Outcome: outcomeSuccess, Detail: map[string]string{"address": address}})
+
+	var payload jsonResponse
+	payload.Error = false
+	payload.StatusCode = http.StatusCreated
+	payload.Message = "wallet linked"
+	payload.Data = link
+
+	app.writeJSON(w, http.StatusCreated, payload)
+}
+
+func (app *Config) ListWallets(w http.ResponseWriter, r *http.Request) {
+	principal, ok := app.walletOwner(w, r)
+	if !ok {
+		return
+	}
+
+	wallets := []walletLink{}
+	err := app.Store.each(walletsBucket, func(_ string, value []byte) error {
+		var link walletLink
+		if err := json.Unmarshal(value, &link); err != nil {
+			return err
+		}
+		if link.UserID == principal.UserID {
+			wallets = append(wallets, link)
+		}
+		return nil
+	})
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+
+	sort.Slice(wallets, func(i, j int) bool { return wallets[i].LinkedAt.After(wallets[j].LinkedAt) })
+
+	var payload jsonResponse
+	payload.Error = false
+	payload.StatusCode = http.StatusOK
+	payload.Message = "wallets"
+	payload.Data = wallets
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+func (app *Config) UnlinkWallet(w http.ResponseWriter, r *http.Request) {
+	principal, ok := app.walletOwner(w, r)
+	if !ok {
+		return
+	}
+
+	key := strings.ToLower(chi.URLParam(r, "address"))
+	var link walletLink
+	found, err := app.Store.get(walletsBucket, key, &link)
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+	if !found || link.UserID != principal.UserID {
+		app.errorJSON(w, errWalletNotLinked, nil, http.StatusNotFound)
+		return
+	}
+
+	err = app.Store.delete(walletsBucket, key)
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+
+	app.audit(r, auditEvent{Type: "wallet.unlinked", Outcome: outcomeSuccess, Detail: map[string]string{"address": link.Address}})
+
+	var payload jsonResponse
+	payload.Error = false
+	payload.StatusCode = http.StatusOK
+	payload.Message = "wallet unlinked"
+	payload.Data = link
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var errKeyExists = errors.New("key already exists")
+
+// Store is the embedded key value store the broker keeps its own state in, values are stored as json
+type Store struct {
+	db *bolt.DB
+}
+
+// openStore opens, creating it when needed, the bolt database at path
+func openStore(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// put stores value under key in bucket, replacing any previous value
+func (s *Store) put(bucket, key string, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), data)
+	})
+}
+
+// get decodes the value of key into value, reporting whether it was found
+func (s *Store) get(bucket, key string, value any) (bool, error) {
+	var data []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		if v := b.Get([]byte(key)); v != nil {
+			data = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	if err != nil || data == nil {
+		return false, err
+	}
+
+	return true, json.Unmarshal(data, value)
+}
+
+// insert stores value under key in bucket unless the key is taken, then it fails with errKeyExists
+func (s *Store) insert(bucket, key string, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		if b.Get([]byte(key)) != nil {
+			return errKeyExists
+		}
+		return b.Put([]byte(key), data)
+	})
+}
+
+func (s *Store) delete(bucket, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+// each calls fn with every key and raw json value of bucket in key order
+func (s *Store) each(bucket string, fn func(key string, value []byte) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			return fn(string(k), v)
+		})
+	})
+}
+
+// page returns copies of up to limit raw json values of bucket that come after the key after, in key
+// order, and the key of the last one. Callers work on them once the read transaction is closed, so a
+// slow reader doesn't hold up writers
+func (s *Store) page(bucket, after string, limit int) ([][]byte, string, error) {
+	var values [][]byte
+	last := after
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		k, v := c.First()
+		if after != "" {
+			k, v = c.Seek([]byte(after))
+			if k != nil && string(k) == after {
+				k, v = c.Next()
+			}
+		}
+		for ; k != nil && len(values) < limit; k, v = c.Next() {
+			values = append(values, append([]byte(nil), v...))
+			last = string(k)
+		}
+		return nil
+	})
+	return values, last, err
+}
+
+// modify decodes key into value, lets fn change it and writes it back in a single transaction, so
+// concurrent callers can't act on the same stale value. fn aborts the write by returning an error
+func (s *Store) modify(bucket, key string, value any, fn func(found bool) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+
+		found := false
+		if v := b.Get([]byte(key)); v != nil {
+			found = true
+			if err := json.Unmarshal(v, value); err != nil {
+				return err
+			}
+		}
+
+		if err := fn(found); err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), data)
+	})
+}
+
+// modifyEach is modify for several keys in a single transaction. value returns what to decode key into
+// and fn changes it, an error from fn aborts every write
+func (s *Store) modifyEach(bucket string, keys []string, value func(key string) any, fn func(key string, found bool) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			v := value(key)
+			found := false
+			if data := b.Get([]byte(key)); data != nil {
+				found = true
+				if err := json.Unmarshal(data, v); err != nil {
+					return err
+				}
+			}
+
+			if err := fn(key, found); err != nil {
+				return err
+			}
+
+			data, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(key), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// append adds count values under increasing sequence keys in a single transaction. fn builds the
+// value for every sequence number and gets the raw json of the entry before it, nil for the first
+func (s *Store) append(bucket string, count int, fn func(i int, seq uint64, previous []byte) (any, error)) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+
+		_, previous := b.Cursor().Last()
+		for i := 0; i < count; i++ {
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			value, err := fn(i, seq, previous)
+			if err != nil {
+				return err
+			}
+			data, err := json.Marshal(value)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(sequenceKey(seq)), data); err != nil {
+				return err
+			}
+			previous = data
+		}
+		return nil
+	})
+}
+
+// sequenceKey zero pads seq so keys sort in the order they were appended
+func sequenceKey(seq uint64) string {
+	return fmt.Sprintf("%020d", seq)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// tokenIssuer mints the broker's own short lived access tokens
+type tokenIssuer struct {
+	Secret     []byte
+	Issuer     string
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+}
+
+// loadTokenIssuer returns nil when BROKER_JWT_SECRET is unset, Login then only forwards the
+// tokens of the auth service
+func loadTokenIssuer() *tokenIssuer {
+	secret := os.Getenv("BROKER_JWT_SECRET")
+	if secret == "" {
+		return nil
+	}
+
+	return &tokenIssuer{
+		Secret:     []byte(secret),
+		Issuer:     envOr("BROKER_JWT_ISSUER", "swiftlink-broker"),
+		AccessTTL:  envDuration("ACCESS_TOKEN_TTL", 15*time.Minute),
+		RefreshTTL: envDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour),
+	}
+}
+
+// issued reports whether token claims to come from the broker, without verifying it
+func (t *tokenIssuer) issued(token string) bool {
+	claims := jwt.MapClaims{}
+	_, _, err := jwt.NewParser().ParseUnverified(token, claims)
+	if err != nil {
+		return false
+	}
+	issuer, _ := claims.GetIssuer()
+	return issuer == t.Issuer
+}
+
+func (t *tokenIssuer) verify(token string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (any, error) {
+		return t.Secret, nil
+	}, jwt.WithValidMethods([]string{"HS256"}), jwt.WithIssuer(t.Issuer), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// accessToken mints an access token for the principal, tied to the session it was issued in
+func (t *tokenIssuer) accessToken(principal *Principal, sessionID string) (string, time.Time, error) {
+	if principal.UserID == "" {
+		return "", time.Time{}, errors.New("can't issue a token without a user")
+	}
+
+	jti, err := randomString(16)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	now := time.Now().UTC()
+	expiresAt := now.Add(t.AccessTTL)
+	claims := jwt.MapClaims{
+		"iss":   t.Issuer,
+		"sub":   principal.UserID,
+		"email": principal.Email,
+		"roles": principal.Roles,
+		"sid":   sessionID,
+		"jti":   jti,
+		"iat":   now.Unix(),
+		"nbf":   now.Unix(),
+		"exp":   expiresAt.Unix(),
+	}
+
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(t.Secret)
+	return signed, expiresAt, err
+}
@@ -0,0 +1,888 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// codes are RFC 6238 TOTP with the parameters every authenticator app supports
+const (
+	twoFactorBucket   = "two_factor"
+	challengesBucket  = "two_factor_challenges"
+	totpPeriod        = 30
+	totpDigits        = 6
+	totpSecretSize    = 20
+	recoveryCodeSize  = 10
+	auditTwoFactor    = "2fa"
+	challengeTokenTag = "tfa_"
+)
+
+var (
+	errInvalidTwoFactorCode    = newCodedError("two_factor.invalid_code")
+	errInvalidChallenge        = newCodedError("two_factor.invalid_challenge")
+	errTwoFactorRequired       = newCodedError("two_factor.required")
+	errTwoFactorNotEnrolled    = errors.New("two-factor authentication is not enabled")
+	errTwoFactorAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+)
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// twoFactorPolicy holds the two-factor settings that come from the environment. Secrets are sealed
+// with a key derived from TOTP_ENCRYPTION_KEY, or BROKER_JWT_SECRET when that isn't set
+type twoFactorPolicy struct {
+	Issuer        string
+	RequiredRoles []string
+	Skew          int
+	ChallengeTTL  time.Duration
+	MaxAttempts   int
+	RecoveryCodes int
+	key           [32]byte
+}
+
+// twoFactor is the enrollment of a user, keyed by user id. It is pending until the first code
+// from the authenticator app activates it
+type twoFactor struct {
+	UserID        string         `json:"user_id"`
+	Email         string         `json:"email,omitempty"`
+	Secret        string         `json:"secret"`
+	Enabled       bool           `json:"enabled"`
+	CreatedAt     time.Time      `json:"created_at"`
+	EnabledAt     *time.Time     `json:"enabled_at,omitempty"`
+	LastStep      int64          `json:"last_step"`
+	RecoveryCodes []recoveryCode `json:"recovery_codes,omitempty"`
+}
+
+// recoveryCode is stored as the hash of the code, each works once
+type recoveryCode struct {
+	Hash   string     `json:"hash"`
+	UsedAt *time.Time `json:"used_at,omitempty"`
+}
+
+// loginChallenge is a login whose password checked out, waiting for the second factor. The broker
+// issues its own tokens once both checked out, without them the response of the auth service is
+// kept sealed in Data so the client only gets it after both
+type loginChallenge struct {
+	UserID    string    `json:"user_id"`
+	Email     string    `json:"email"`
+	Roles     []string  `json:"roles,omitempty"`
+	Data      string    `json:"data,omitempty"`
+	Enroll    bool      `json:"enroll"`
+	Attempts  int       `json:"attempts"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type TwoFactorCodePayload struct {
+	Code string `json:"code" validate:"required,max=32"`
+}
+
+type TwoFactorChallengePayload struct {
+	ChallengeToken string `json:"challenge_token" validate:"required,max=128"`
+}
+
+type TwoFactorLoginPayload struct {
+	ChallengeToken string `json:"challenge_token" validate:"required,max=128"`
+	Code           string `json:"code" validate:"required,max=32"`
+}
+
+// loadTwoFactorPolicy returns nil when there is no key to seal secrets with, two-factor is off then
+// and no role can require it
+func loadTwoFactorPolicy() *twoFactorPolicy {
+	// two-factor is optional for everyone unless TWO_FACTOR_REQUIRED_ROLES names roles, e.g. "admin"
+	var roles []string
+	for _, role := range strings.Split(os.Getenv("TWO_FACTOR_REQUIRED_ROLES"), ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			roles = append(roles, role)
+		}
+	}
+
+	secret := envOr("TOTP_ENCRYPTION_KEY", os.Getenv("BROKER_JWT_SECRET"))
+	if secret == "" {
+		if len(roles) > 0 {
+			log.Printf("two-factor authentication is off, so it is not required for %s. Set TOTP_ENCRYPTION_KEY or BROKER_JWT_SECRET to enforce it", strings.Join(roles, ","))
+		}
+		return nil
+	}
+
+	return &twoFactorPolicy{
+		Issuer:        envOr("TOTP_ISSUER", "SwiftLink Broker"),
+		RequiredRoles: roles,
+		Skew:          envInt("TOTP_SKEW", 1),
+		ChallengeTTL:  envDuration("TWO_FACTOR_CHALLENGE_TTL", 5*time.Minute),
+		MaxAttempts:   envInt("TWO_FACTOR_MAX_ATTEMPTS", 5),
+		RecoveryCodes: envInt("TWO_FACTOR_RECOVERY_CODES", 10),
+		key:           sha256.Sum256([]byte("totp:" + secret)),
+	}
+}
+
+// requiredFor reports whether any of roles must log in with a second factor
+func (p *twoFactorPolicy) requiredFor(roles []string) bool {
+	for _, role := range roles {
+		for _, required := range p.RequiredRoles {
+			if strings.EqualFold(role, required) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p *twoFactorPolicy) seal(secret []byte) (string, error) {
+	gcm, err := p.cipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(gcm.Seal(nonce, nonce, secret, nil)), nil
+}
+
+func (p *twoFactorPolicy) open(sealed string) ([]byte, error) {
+	data, err := base64.RawStdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := p.cipher()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("sealed totp secret is too short")
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
+
+func (p *twoFactorPolicy) cipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(p.key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// provisioningURI is what authenticator apps read from the QR code
+func (p *twoFactorPolicy) provisioningURI(email, secret string) string {
+	query := url.Values{
+		"secret":    {secret},
+		"issuer":    {p.Issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	// some apps show a + in the issuer as it is, %20 is read right by all of them
+	return "otpauth://totp/" + url.PathEscape(p.Issuer+":"+email) + "?" + strings.ReplaceAll(query.Encode(), "+", "%20")
+}
+
+// totpCode is the code of secret for a 30 second step since the unix epoch
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// matchTOTP finds the step of code within skew steps of now. Steps up to last were already used and
+// are refused, so a code can't be replayed
+func matchTOTP(secret []byte, code string, now time.Time, skew int, last int64) (int64, bool) {
+	current := now.Unix() / totpPeriod
+	for offset := -int64(skew); offset <= int64(skew); offset++ {
+		step := current + offset
+		if step > last && subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// newRecoveryCodes returns the codes to show the user once, and their hashes to store
+func newRecoveryCodes(count int) ([]string, []recoveryCode, error) {
+	codes := make([]string, count)
+	hashes := make([]recoveryCode, count)
+	for i := range codes {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(base32NoPadding.EncodeToString(b))[:recoveryCodeSize]
+		codes[i] = code[:recoveryCodeSize/2] + "-" + code[recoveryCodeSize/2:]
+		hashes[i] = recoveryCode{Hash: hashSecret(code)}
+	}
+	return codes, hashes, nil
+}
+
+// useRecoveryCode spends the matching unused recovery code
+func (tf *twoFactor) useRecoveryCode(code string, now time.Time) bool {
+	hash := []byte(hashSecret(strings.ToLower(strings.ReplaceAll(code, "-", ""))))
+	for i := range tf.RecoveryCodes {
+		if tf.RecoveryCodes[i].UsedAt == nil && subtle.ConstantTimeCompare([]byte(tf.RecoveryCodes[i].Hash), hash) == 1 {
+			tf.RecoveryCodes[i].UsedAt = &now
+			return true
+		}
+	}
+	return false
+}
+
+func (tf *twoFactor) recoveryCodesLeft() int {
+	left := 0
+	for _, code := range tf.RecoveryCodes {
+		if code.UsedAt == nil {
+			left++
+		}
+	}
+	return left
+}
+
+func (app *Config) twoFactorOf(userID string) (twoFactor, bool, error) {
+	var tf twoFactor
+	found, err := app.Store.get(twoFactorBucket, userID, &tf)
+	return tf, found, err
+}
+
+// enrollTwoFactor stores a new pending secret for the user, replacing any earlier pending one
+func (app *Config) enrollTwoFactor(userID, email string) (string, error) {
+	raw := make([]byte, totpSecretSize)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	sealed, err := app.TwoFactor.seal(raw)
+	if err != nil {
+		return "", err
+	}
+
+	var tf twoFactor
+	err = app.Store.modify(twoFactorBucket, userID, &tf, func(found bool) error {
+		if found && tf.Enabled {
+			return errTwoFactorAlreadyEnabled
+		}
+		tf = twoFactor{UserID: userID, Email: email, Secret: sealed, CreatedAt: time.Now().UTC()}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return base32NoPadding.EncodeToString(raw), nil
+}
+
+// verifyTwoFactorCode checks a code of the authenticator app, or an unused recovery code once
+// enabled, in the transaction that records its use. A pending enrollment is only accepted when
+// activate is set, it is enabled then and the new recovery codes are returned
+func (app *Config) verifyTwoFactorCode(userID, code string, activate bool) ([]string, error) {
+	code = strings.ReplaceAll(code, " ", "")
+	now := time.Now().UTC()
+
+	var codes []string
+	var tf twoFactor
+	err := app.Store.modify(twoFactorBucket, userID, &tf, func(found bool) error {
+		if !found || (!tf.Enabled && !activate) {
+			return errTwoFactorNotEnrolled
+		}
+		secret, err := app.TwoFactor.open(tf.Secret)
+		if err != nil {
+			return err
+		}
+
+		if step, ok := matchTOTP(secret, code, now, app.TwoFactor.Skew, tf.LastStep); ok {
+			tf.LastStep = step
+		} else if !tf.Enabled || !tf.useRecoveryCode(code, now) {
+			return errInvalidTwoFactorCode
+		}
+
+		if !tf.Enabled {
+			var hashes []recoveryCode
+			codes, hashes, err = newRecoveryCodes(app.TwoFactor.RecoveryCodes)
+			if err != nil {
+				return err
+			}
+			tf.Enabled = true
+			tf.EnabledAt = &now
+			tf.RecoveryCodes = hashes
+		}
+		return nil
+	})
+	return codes, err
+}
+
+// challengeLogin answers a login whose password checked out with a challenge when the account has
+// two-factor enabled, or must enroll because of its roles. It reports whether it did
+func (app *Config) challengeLogin(w http.ResponseWriter, r *http.Request, email string, data any) bool {
+	principal, err := principalFromData(data)
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusBadGateway)
+		return true
+	}
+
+	tf, found, err := app.twoFactorOf(principal.UserID)
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return true
+	}
+	enabled := found && tf.Enabled
+	if !enabled && !app.TwoFactor.requiredFor(principal.Roles) {
+		return false
+	}
+
+	secret, err := randomString(32)
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return true
+	}
+	token := challengeTokenTag + secret
+
+	challenge := loginChallenge{
+		UserID:    principal.UserID,
+		Email:     email,
+		Roles:     principal.Roles,
+		Enroll:    !enabled,
+		ExpiresAt: time.Now().UTC().Add(app.TwoFactor.ChallengeTTL),
+	}
+	//the tokens of the auth service are only kept when the broker has none of its own to hand out
+	if app.Tokens == nil {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			app.errorJSON(w, err, nil, http.StatusInternalServerError)
+			return true
+		}
+		challenge.Data, err = app.TwoFactor.seal(raw)
+		if err != nil {
+			app.errorJSON(w, err, nil, http.StatusInternalServerError)
+			return true
+		}
+	}
+	err = app.Store.put(challengesBucket, hashSecret(token), challenge)
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return true
+	}
+
+	app.audit(r, auditEvent{Type: auditTwoFactor + ".challenge", Actor: principal.UserID, Email: email, Status: http.StatusOK,
+		Outcome: outcomeSuccess, Detail: map[string]string{"enrollment_required": fmt.Sprint(!enabled)}})
+
+	var payload jsonResponse
+	payload.Error = false
+	payload.StatusCode = http.StatusOK
+	payload.Message = "two-factor authentication required"
+	if !enabled {
+		payload.Message = "two-factor authentication must be set up before logging in"
+	}
+	payload.Data = map[string]any{
+		"two_factor_required": true,
+		"enrollment_required": !enabled,
+		"challenge_token":     token,
+		"expires_in":          int64(app.TwoFactor.ChallengeTTL.Seconds()),
+	}
+
+	app.writeJSON(w, http.StatusOK, payload)
+	return true
+}
+
+// loginChallengeOf loads a challenge that hasn't expired yet
+func (app *Config) loginChallengeOf(token string) (loginChallenge, error) {
+	var challenge loginChallenge
+	found, err := app.Store.get(challengesBucket, hashSecret(token), &challenge)
+	if err != nil {
+		return loginChallenge{}, err
+	}
+	if !found || !strings.HasPrefix(token, challengeTokenTag) || time.Now().After(challenge.ExpiresAt) {
+		return loginChallenge{}, errInvalidChallenge
+	}
+	return challenge, nil
+}
+
+// attemptLoginChallenge spends one of the guesses of a challenge before its code is compared, in
+// the transaction that checks there are any left, so parallel guesses can't go past MaxAttempts
+func (app *Config) attemptLoginChallenge(token string) (loginChallenge, error) {
+	var challenge loginChallenge
+	err := app.Store.modify(challengesBucket, hashSecret(token), &challenge, func(found bool) error {
+		if !found || !strings.HasPrefix(token, challengeTokenTag) || time.Now().After(challenge.ExpiresAt) {
+			return errInvalidChallenge
+		}
+		if challenge.Attempts >= app.TwoFactor.MaxAttempts {
+			return errInvalidChallenge
+		}
+		challenge.Attempts++
+		return nil
+	})
+	return challenge, err
+}
+
+// loginData is what the client gets once the second factor checked out. Without broker tokens it
+// is the sealed response of the auth service, otherwise the account the broker issues tokens for
+func (app *Config) loginData(challenge loginChallenge) (any, error) {
+	if challenge.Data == "" {
+		return map[string]any{"user_id": challenge.UserID, "email": challenge.Email, "roles": challenge.Roles}, nil
+	}
+
+	raw, err := app.TwoFactor.open(challenge.Data)
+	if err != nil {
+		return nil, err
+	}
+	var data any
+	err = json.Unmarshal(raw, &data)
+	return data, err
+}
+
+// twoFactorSatisfied reports whether the principal may be authenticated, a principal whose roles
+// require two-factor has to have it enabled whatever credential it comes with
+func (app *Config) twoFactorSatisfied(principal *Principal) (bool, error) {
+	if app.TwoFactor == nil || !app.TwoFactor.requiredFor(principal.Roles) {
+		return true, nil
+	}
+	tf, found, err := app.twoFactorOf(principal.UserID)
+	if err != nil {
+		return false, err
+	}
+	return found && tf.Enabled, nil
+}
+
+// twoFactorEnabled answers with a 404 when the broker has no key to seal secrets with
+func (app *Config) twoFactorEnabled(w http.ResponseWriter) bool {
+	if app.TwoFactor == nil {
+		app.errorJSON(w, errors.New("two-factor authentication is not enabled"), nil, http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// twoFactorOwner returns the principal when it may manage its second factor, api keys have none
+func (app *Config) twoFactorOwner(w http.ResponseWriter, r *http.Request) (*Principal, bool) {
+	if !app.twoFactorEnabled(w) {
+		return nil, false
+	}
+	principal, ok := principalFrom(r.Context())
+	if !ok {
+		app.errorJSON(w, newCodedError("auth.unauthorized"), nil, http.StatusUnauthorized)
+		return nil, false
+	}
+	if principal.APIKeyID != "" {
+		app.errorJSON(w, errors.New("two-factor authentication can only be managed with a bearer token"), nil, http.StatusForbidden)
+		return nil, false
+	}
+	return principal, true
+}
+
+// purgeLoginChallenges drops challenges that expired without being answered, on every tick
+func (app *Config) purgeLoginChallenges(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var stale []string
+		now := time.Now()
+		err := app.Store.each(challengesBucket, func(key string, value []byte) error {
+			var challenge loginChallenge
+			if err := json.Unmarshal(value, &challenge); err != nil || now.After(challenge.ExpiresAt) {
+				stale = append(stale, key)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Println("error reading login challenges", err)
+			continue
+		}
+
+		for _, key := range stale {
+			if err := app.Store.delete(challengesBucket, key); err != nil {
+				log.Println("error purging login challenges", err)
+			}
+		}
+	}
+}
+
+func (app *Config) TwoFactorStatus(w http.ResponseWriter, r *http.Request) {
+	principal, ok := app.twoFactorOwner(w, r)
+	if !ok {
+		return
+	}
+
+	tf, found, err := app.twoFactorOf(principal.UserID)
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+
+	status := map[string]any{
+		"enabled":  found && tf.Enabled,
+		"pending":  found && !tf.Enabled,
+		"required": app.TwoFactor.requiredFor(principal.Roles),
+	}
+	if found && tf.Enabled {
+		status["enabled_at"] = tf.EnabledAt
+		status["recovery_codes_left"] = tf.recoveryCodesLeft()
+	}
+
+	var payload jsonResponse
+	payload.Error = false
+	payload.StatusCode = http.StatusOK
+	payload.Message = "two-factor status"
+	payload.Data = status
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+// EnrollTwoFactor starts the enrollment of a logged in user, ActivateTwoFactor completes it
+func (app *Config) EnrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	principal, ok := app.twoFactorOwner(w, r)
+	if !ok {
+		return
+	}
+	app.writeEnrollment(w, r, principal.UserID, principal.Email)
+}
+
+// EnrollTwoFactorLogin starts the enrollment of a user whose role requires two-factor, with the
+// challenge of their login. VerifyTwoFactorLogin completes it and the login together
+func (app *Config) EnrollTwoFactorLogin(w http.ResponseWriter, r *http.Request) {
+	if !app.twoFactorEnabled(w) {
+		return
+	}
+
+	var requestPayload TwoFactorChallengePayload
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, nil)
+		return
+	}
+
+	challenge, err := app.loginChallengeOf(requestPayload.ChallengeToken)
+	if errors.Is(err, errInvalidChallenge) {
+		app.errorJSON(w, err, nil, http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+	if !challenge.Enroll {
+		app.errorJSON(w, errTwoFactorAlreadyEnabled, nil, http.StatusConflict)
+		return
+	}
+
+	app.writeEnrollment(w, r, challenge.UserID, challenge.Email)
+}
+
+func (app *Config) writeEnrollment(w http.ResponseWriter, r *http.Request, userID, email string) {
+	secret, err := app.enrollTwoFactor(userID, email)
+	if errors.Is(err, errTwoFactorAlreadyEnabled) {
+		app.errorJSON(w, err, nil, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+
+	app.audit(r, auditEvent{Type: auditTwoFactor + ".enrolled", Actor: userID, Email: email, Outcome: outcomeSuccess})
+
+	var payload jsonResponse
+	payload.Error = false
+	payload.StatusCode = http.StatusOK
+	payload.Message = "add the secret to your authenticator app and confirm with its first code"
+	payload.Data = map[string]any{
+		"secret":           secret,
+		"provisioning_uri": app.TwoFactor.provisioningURI(email, secret),
+		"digits":           totpDigits,
+		"period":           totpPeriod,
+	}
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+// ActivateTwoFactor confirms a pending enrollment with a code and returns the recovery codes, they
+// are shown this one time only
+func (app *Config) ActivateTwoFactor(w http.ResponseWriter, r *http.Request) {
+	principal, ok := app.twoFactorOwner(w, r)
+	if !ok {
+		return
+	}
+
+	var requestPayload TwoFactorCodePayload
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, nil)
+		return
+	}
+
+	tf, found, err := app.twoFactorOf(principal.UserID)
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+	if found && tf.Enabled {
+		app.errorJSON(w, errTwoFactorAlreadyEnabled, nil, http.StatusConflict)
+		return
+	}
+
+	codes, err := app.verifyTwoFactorCode(principal.UserID, requestPayload.Code, true)
+	if errors.Is(err, errTwoFactorNotEnrolled) {
+		app.errorJSON(w, errors.New("start the enrollment first"), nil, http.StatusConflict)
+		return
+	}
+	if errors.Is(err, errInvalidTwoFactorCode) {
+		app.errorJSON(w, err, nil, http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+
+	app.audit(r, auditEvent{Type: auditTwoFactor + ".enabled", Outcome: outcomeSuccess})
+
+	var payload jsonResponse
+	payload.Error = false
+	payload.StatusCode = http.StatusOK
+	payload.Message = "two-factor authentication enabled, store the recovery codes now as they can't be shown again"
+	payload.Data = map[string]any{"recovery_codes": codes}
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+// DisableTwoFactor turns two-factor off with a current code, unless a role of the user requires it
+func (app *Config) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	principal, ok := app.twoFactorOwner(w, r)
+	if !ok {
+		return
+	}
+
+	var requestPayload TwoFactorCodePayload
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, nil)
+		return
+	}
+
+	if app.TwoFactor.requiredFor(principal.Roles) {
+		app.errorJSON(w, errors.New("two-factor authentication is required for your role"), nil, http.StatusForbidden)
+		return
+	}
+
+	_, err = app.verifyTwoFactorCode(principal.UserID, requestPayload.Code, false)
+	if errors.Is(err, errTwoFactorNotEnrolled) {
+		app.errorJSON(w, err, nil, http.StatusConflict)
+		return
+	}
+	if errors.Is(err, errInvalidTwoFactorCode) {
+		app.errorJSON(w, err, nil, http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+
+	err = app.Store.delete(twoFactorBucket, principal.UserID)
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+
+	app.audit(r, auditEvent{Type: auditTwoFactor + ".disabled", Outcome: outcomeSuccess})
+
+	var payload jsonResponse
+	payload.Error = false
+	payload.StatusCode = http.StatusOK
+	payload.Message = "two-factor authentication disabled"
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+// RegenerateRecoveryCodes replaces every recovery code, used or not, after checking a current code
+func (app *Config) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	principal, ok := app.twoFactorOwner(w, r)
+	if !ok {
+		return
+	}
+
+	var requestPayload TwoFactorCodePayload
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, nil)
+		return
+	}
+
+	_, err = app.verifyTwoFactorCode(principal.UserID, requestPayload.Code, false)
+	if errors.Is(err, errTwoFactorNotEnrolled) {
+		app.errorJSON(w, err, nil, http.StatusConflict)
+		return
+	}
+	if errors.Is(err, errInvalidTwoFactorCode) {
+		app.errorJSON(w, err, nil, http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes(app.TwoFactor.RecoveryCodes)
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+	var tf twoFactor
+	err = app.Store.modify(twoFactorBucket, principal.UserID, &tf, func(found bool) error {
+		if !found || !tf.Enabled {
+			return errTwoFactorNotEnrolled
+		}
+		tf.RecoveryCodes = hashes
+		return nil
+	})
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+
+	app.audit(r, auditEvent{Type: auditTwoFactor + ".recovery_codes_regenerated", Outcome: outcomeSuccess})
+
+	var payload jsonResponse
+	payload.Error = false
+	payload.StatusCode = http.StatusOK
+	payload.Message = "recovery codes replaced, store them now as they can't be shown again"
+	payload.Data = map[string]any{"recovery_codes": codes}
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+// VerifyTwoFactorLogin answers a login challenge with a code of the authenticator app or a recovery
+// code, and completes the login. Wrong codes count as failed logins of the email
+func (app *Config) VerifyTwoFactorLogin(w http.ResponseWriter, r *http.Request) {
+	if !app.twoFactorEnabled(w) {
+		return
+	}
+
+	var requestPayload TwoFactorLoginPayload
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, nil)
+		return
+	}
+
+	challenge, err := app.loginChallengeOf(requestPayload.ChallengeToken)
+	if errors.Is(err, errInvalidChallenge) {
+		app.errorJSON(w, err, nil, http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+
+	if !app.guardLogin(w, r, challenge.Email) {
+		return
+	}
+
+	// a challenge only gets a few guesses, the login has to start over after that
+	key := hashSecret(requestPayload.ChallengeToken)
+	challenge, err = app.attemptLoginChallenge(requestPayload.ChallengeToken)
+	if errors.Is(err, errInvalidChallenge) {
+		if err := app.Store.delete(challengesBucket, key); err != nil {
+			log.Println("error deleting spent login challenge", err)
+		}
+		app.errorJSON(w, err, nil, http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+
+	codes, err := app.verifyTwoFactorCode(challenge.UserID, requestPayload.Code, challenge.Enroll)
+	if errors.Is(err, errInvalidTwoFactorCode) || errors.Is(err, errTwoFactorNotEnrolled) {
+		if err := app.recordLoginFailure(challenge.Email, clientIP(r)); err != nil {
+			log.Println("error recording failed login", err)
+		}
+		app.audit(r, auditEvent{Type: auditLogin, Actor: challenge.UserID, Email: challenge.Email, Status: http.StatusUnauthorized,
+			Outcome: outcomeFailure, Detail: map[string]string{"reason": "invalid two-factor code"}})
+
+		if challenge.Attempts >= app.TwoFactor.MaxAttempts {
+			if err := app.Store.delete(challengesBucket, key); err != nil {
+				log.Println("error deleting spent login challenge", err)
+			}
+		}
+
+		app.errorJSON(w, errInvalidTwoFactorCode, nil, http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+
+	// a challenge completes a single login
+	err = app.Store.delete(challengesBucket, key)
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+
+	data, err := app.loginData(challenge)
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+	if len(codes) > 0 {
+		app.audit(r, auditEvent{Type: auditTwoFactor + ".enabled", Actor: challenge.UserID, Email: challenge.Email, Outcome: outcomeSuccess})
+		data = mergeData(data, map[string]any{"recovery_codes": codes})
+	}
+
+	app.completeLogin(w, r, challenge.Email, "logged in", data)
+}
+
+// ResetTwoFactor removes the second factor of a user who lost it, their next login enrolls again
+// when a role requires it
+func (app *Config) ResetTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if !app.twoFactorEnabled(w) {
+		return
+	}
+
+	userID := chi.URLParam(r, "userID")
+	_, found, err := app.twoFactorOf(userID)
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		app.errorJSON(w, errTwoFactorNotEnrolled, nil, http.StatusNotFound)
+		return
+	}
+
+	err = app.Store.delete(twoFactorBucket, userID)
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+
+	app.audit(r, auditEvent{Type: "admin.2fa_reset", Outcome: outcomeSuccess, Detail: map[string]string{"user_id": userID}})
+
+	var payload jsonResponse
+	payload.Error = false
+	payload.StatusCode = http.StatusOK
+	payload.Message = "two-factor authentication reset"
+	payload.Data = map[string]string{"user_id": userID}
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	strategyWeighted     = "weighted"
+	strategyLeastLatency = "least-latency"
+)
+
+// upstreamNode is a single SERVICE_URL instance and the health the broker has observed for it
+type upstreamNode struct {
+	URL    string
+	Weight int
+
+	healthy             bool
+	consecutiveFailures int
+	consecutiveSuccess  int
+	currentWeight       int
+	latency             time.Duration
+	lastChecked         time.Time
+	lastError           string
+	requests            int64
+	failures            int64
+}
+
+type upstreamNodeStatus struct {
+	URL                 string    `json:"url"`
+	Weight              int       `json:"weight"`
+	Healthy             bool      `json:"healthy"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	LatencyMS           float64   `json:"latency_ms"`
+	LastChecked         time.Time `json:"last_checked,omitempty"`
+	LastError           string    `json:"last_error,omitempty"`
+	Requests            int64     `json:"requests"`
+	Failures            int64     `json:"failures"`
+}
+
+// upstreamPool balances the POS routes of one network over its upstream nodes
+type upstreamPool struct {
+	Network     string
+	Strategy    string
+	MaxFailures int
+	Rise        int
+	HealthPath  string
+	HedgeAfter  time.Duration
+
+	mu          sync.Mutex
+	nodes       []*upstreamNode
+	client      *http.Client
+	hedgesFired int64
+	hedgesWon   int64
+}
+
+type hedgeStatus struct {
+	AfterMS float64 `json:"after_ms"`
+	Fired   int64   `json:"fired"`
+	Won     int64   `json:"won"`
+	WinRate float64 `json:"win_rate"`
+}
+
+// hedgeAttempt is the outcome of one of the requests raced by a hedged call
+type hedgeAttempt struct {
+	response *http.Response
+	err      error
+	hedge    bool
+}
+
+// cancelOnClose releases the context of the winning attempt once its body has been read
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+// loadUpstreams builds a pool per network from <NETWORK>_SERVICE_URLS, a comma separated list of
+// url or url|weight entries, falling back to the single SERVICE_URL
+func loadUpstreams() map[string]*upstreamPool {
+	pools := map[string]*upstreamPool{}
+
+	for _, network := range []string{"mainnet", "testnet"} {
+		urls := os.Getenv(strings.ToUpper(network) + "_SERVICE_URLS")
+		if urls == "" {
+			urls = os.Getenv("SERVICE_URL")
+		}
+
+		pool := &upstreamPool{
+			Network:     network,
+			Strategy:    envOr("UPSTREAM_STRATEGY", strategyWeighted),
+			MaxFailures: envInt("UPSTREAM_MAX_FAILURES", 3),
+			Rise:        envInt("UPSTREAM_RISE", 2),
+			HealthPath:  envOr("UPSTREAM_HEALTH_PATH", "ping"),
+			HedgeAfter:  envDuration("UPSTREAM_HEDGE_AFTER", 0),
+			client:      &http.Client{Timeout: 30 * time.Second},
+		}
+
+		for _, entry := range strings.Split(urls, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+
+			node := &upstreamNode{URL: entry, Weight: 1, healthy: true}
+			if u, weight, ok := strings.Cut(entry, "|"); ok {
+				node.URL = u
+				if w, err := strconv.Atoi(weight); err == nil && w > 0 {
+					node.Weight = w
+				}
+			}
+			if !strings.HasSuffix(node.URL, "/") {
+				node.URL += "/"
+			}
+			pool.nodes = append(pool.nodes, node)
+		}
+
+		pools[network] = pool
+	}
+
+	return pools
+}
+
+func envInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// candidates returns the nodes to try in order of preference, healthy ones first
+func (p *upstreamPool) candidates() []*upstreamNode {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var healthy, ejected []*upstreamNode
+	for _, node := range p.nodes {
+		if node.healthy {
+			healthy = append(healthy, node)
+		} else {
+			ejected = append(ejected, node)
+		}
+	}
+
+	var ordered []*upstreamNode
+	if len(healthy) > 0 {
+		// only the first choice moves the round robin, the fallbacks are ordered by what the strategy
+		// would pick next without touching the weights of the nodes that were not chosen
+		i := p.pick(healthy)
+		ordered = append(ordered, healthy[i])
+		fallbacks := append(healthy[:i:i], healthy[i+1:]...)
+		sort.SliceStable(fallbacks, func(a, b int) bool {
+			if p.Strategy == strategyLeastLatency {
+				return fallbacks[a].latency < fallbacks[b].latency
+			}
+			return fallbacks[a].currentWeight > fallbacks[b].currentWeight
+		})
+		ordered = append(ordered, fallbacks...)
+	}
+
+	// with every node ejected still try them rather than failing outright
+	return append(ordered, ejected...)
+}
+
+// pick selects the index of the next node, the caller holds the lock
+func (p *upstreamPool) pick(nodes []*upstreamNode) int {
+	if p.Strategy == strategyLeastLatency {
+		best := 0
+		for i, node := range nodes {
+			if node.latency < nodes[best].latency {
+				best = i
+			}
+		}
+		return best
+	}
+
+	// smooth weighted round robin, the same scheme nginx uses
+	total, best := 0, 0
+	for i, node := range nodes {
+		node.currentWeight += node.Weight
+		total += node.Weight
+		if node.currentWeight > nodes[best].currentWeight {
+			best = i
+		}
+	}
+	nodes[best].currentWeight -= total
+	return best
+}
+
+// observe records the outcome of a request or health check against a node
+func (p *upstreamPool) observe(node *upstreamNode, latency time.Duration, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	node.lastChecked = time.Now().UTC()
+	if err != nil {
+		node.failures++
+		node.consecutiveFailures++
+		node.consecutiveSuccess = 0
+		node.lastError = err.Error()
+		if node.healthy && node.consecutiveFailures >= p.MaxFailures {
+			node.healthy = false
+			log.Printf("ejecting %s upstream %s: %s\n", p.Network, node.URL, err)
+		}
+		return
+	}
+
+	node.consecutiveFailures = 0
+	node.consecutiveSuccess++
+	node.lastError = ""
+	if node.latency == 0 {
+		node.latency = latency
+	} else {
+		// exponentially weighted so one slow response does not swing the ranking
+		node.latency = (node.latency*4 + latency) / 5
+	}
+	if !node.healthy && node.consecutiveSuccess >= p.Rise {
+		node.healthy = true
+		log.Printf("restoring %s upstream %s\n", p.Network, node.URL)
+	}
+}
+
+// get calls path on the pool, failing over to the next node on transport errors and 5xx responses
+func (p *upstreamPool) get(ctx context.Context, path string) (*http.Response, error) {
+	nodes := p.candidates()
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no upstream configured for %s", p.Network)
+	}
+
+	var lastErr error
+	if p.HedgeAfter > 0 && len(nodes) > 1 {
+		response, err := p.hedged(ctx, nodes[0], nodes[1], path)
+		if err == nil {
+			return response, nil
+		}
+		lastErr = err
+		nodes = nodes[2:]
+	}
+
+	for _, node := range nodes {
+		response, err := p.send(ctx, node, path)
+		if err == nil {
+			return response, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, lastErr
+}
+
+// hedged sends path to primary and, when it has not answered within HedgeAfter, also to secondary,
+// returning whichever succeeds first
+func (p *upstreamPool) hedged(ctx context.Context, primary, secondary *upstreamNode, path string) (*http.Response, error) {
+	results := make(chan hedgeAttempt, 2)
+	cancels := map[bool]context.CancelFunc{}
+
+	launch := func(node *upstreamNode, hedge bool) {
+		attemptCtx, cancel := context.WithCancel(ctx)
+		cancels[hedge] = cancel
+		go func() {
+			response, err := p.send(attemptCtx, node, path)
+			results <- hedgeAttempt{response: response, err: err, hedge: hedge}
+		}()
+	}
+
+	launch(primary, false)
+	timer := time.NewTimer(p.HedgeAfter)
+	defer timer.Stop()
+
+	inflight, secondaryLaunched, hedgeFired := 1, false, false
+	var lastErr error
+	for inflight > 0 {
+		select {
+		case <-timer.C:
+			if !secondaryLaunched {
+				secondaryLaunched, hedgeFired = true, true
+				inflight++
+				p.mu.Lock()
+				p.hedgesFired++
+				p.mu.Unlock()
+				launch(secondary, true)
+			}
+
+		case attempt := <-results:
+			inflight--
+			if attempt.err != nil {
+				cancels[attempt.hedge]()
+				lastErr = attempt.err
+				// the primary failed outright, fail over without waiting for the hedge delay
+				if !secondaryLaunched {
+					secondaryLaunched = true
+					inflight++
+					launch(secondary, true)
+				}
+				continue
+			}
+
+			if hedgeFired && attempt.hedge {
+				p.mu.Lock()
+				p.hedgesWon++
+				p.mu.Unlock()
+			}
+
+			// abandon the slower request and discard whatever it returns
+			if inflight > 0 {
+				cancels[!attempt.hedge]()
+				go func() {
+					if loser := <-results; loser.response != nil {
+						loser.response.Body.Close()
+					}
+				}()
+			}
+
+			attempt.response.Body = &cancelOnClose{ReadCloser: attempt.response.Body, cancel: cancels[attempt.hedge]}
+			return attempt.response, nil
+		}
+	}
+
+	return nil, lastErr
+}
+
+// send performs a single request against node and records the outcome
+func (p *upstreamPool) send(ctx context.Context, node *upstreamNode, path string) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", node.URL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	forwardPrincipal(ctx, request)
+
+	p.mu.Lock()
+	node.requests++
+	p.mu.Unlock()
+
+	start := time.Now()
+	response, err := p.client.Do(request)
+	if err == nil && response.StatusCode >= http.StatusInternalServerError {
+		response.Body.Close()
+		err = fmt.Errorf("upstream returned status %d", response.StatusCode)
+	}
+	if err != nil && errors.Is(err, context.Canceled) {
+		// the caller went away, that says nothing about the node
+		return nil, err
+	}
+	p.observe(node, time.Since(start), err)
+
+	return response, err
+}
+
+// healthCheck actively probes every node on each tick
+func (p *upstreamPool) healthCheck(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		p.mu.Lock()
+		nodes := append([]*upstreamNode(nil), p.nodes...)
+		p.mu.Unlock()
+
+		for _, node := range nodes {
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			request, err := http.NewRequestWithContext(ctx, "GET", node.URL+p.HealthPath, nil)
+			if err != nil {
+				cancel()
+				continue
+			}
+
+			start := time.Now()
+			response, err := p.client.Do(request)
+			if err == nil {
+				response.Body.Close()
+				if response.StatusCode >= http.StatusBadRequest {
+					err = fmt.Errorf("health check returned status %d", response.StatusCode)
+				}
+			}
+			cancel()
+			p.observe(node, time.Since(start), err)
+		}
+	}
+}
+
+func (p *upstreamPool) status() []upstreamNodeStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	status := make([]upstreamNodeStatus, 0, len(p.nodes))
+	for _, node := range p.nodes {
+		status = append(status, upstreamNodeStatus{
+			URL:                 node.URL,
+			Weight:              node.Weight,
+			Healthy:             node.healthy,
+			ConsecutiveFailures: node.consecutiveFailures,
+			LatencyMS:           float64(node.latency.Microseconds()) / 1000,
+			LastChecked:         node.lastChecked,
+			LastError:           node.lastError,
+			Requests:            node.requests,
+			Failures:            node.failures,
+		})
+	}
+	return status
+}
+
+func (p *upstreamPool) hedgeStatus() hedgeStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	status := hedgeStatus{
+		AfterMS: float64(p.HedgeAfter.Microseconds()) / 1000,
+		Fired:   p.hedgesFired,
+		Won:     p.hedgesWon,
+	}
+	if p.hedgesFired > 0 {
+		status.WinRate = float64(p.hedgesWon) / float64(p.hedgesFired)
+	}
+	return status
+}
+
+func (app *Config) UpstreamStatus(w http.ResponseWriter, r *http.Request) {
+
+	status := map[string]any{}
+	for network, pool := range app.Upstreams {
+		status[network] = map[string]any{
+			"strategy": pool.Strategy,
+			"nodes":    pool.status(),
+			"hedging":  pool.hedgeStatus(),
+		}
+	}
+
+	var payload jsonResponse
+	payload.Error = false
+	payload.StatusCode = http.StatusOK
+	payload.Message = "upstream status"
+	payload.Data = status
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
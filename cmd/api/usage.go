@@ -0,0 +1,469 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const usageBucket = "usage"
+
+// usage is accounted per calendar month in UTC
+const usageMonthLayout = "2006-01"
+
+// defaultUsageQuotas apply unless USAGE_QUOTAS overrides them, roles without a quota are unlimited
+const defaultUsageQuotas = "viewer=50000;api-client=200000"
+
+// usageRecord is what one principal used in one month, stored under "<month>|<principal>". APIKeys
+// breaks the requests down by the api keys of the user that made them
+type usageRecord struct {
+	Month     string           `json:"month"`
+	Principal string           `json:"principal"`
+	UserID    string           `json:"user_id"`
+	Requests  int64            `json:"requests"`
+	Routes    map[string]int64 `json:"routes"`
+	Networks  map[string]int64 `json:"networks,omitempty"`
+	APIKeys   map[string]int64 `json:"api_keys,omitempty"`
+	UpdatedAt time.Time        `json:"updated_at"`
+}
+
+func (u *usageRecord) add(other *usageRecord) {
+	if u.Routes == nil {
+		u.Routes = map[string]int64{}
+	}
+	if u.Networks == nil {
+		u.Networks = map[string]int64{}
+	}
+	if u.APIKeys == nil {
+		u.APIKeys = map[string]int64{}
+	}
+
+	u.Month, u.Principal, u.UserID = other.Month, other.Principal, other.UserID
+	u.Requests += other.Requests
+	for route, n := range other.Routes {
+		u.Routes[route] += n
+	}
+	for network, n := range other.Networks {
+		u.Networks[network] += n
+	}
+	for key, n := range other.APIKeys {
+		u.APIKeys[key] += n
+	}
+	if other.UpdatedAt.After(u.UpdatedAt) {
+		u.UpdatedAt = other.UpdatedAt
+	}
+}
+
+// usageMeter counts requests in memory and periodically adds them to the records in the store. mu
+// guards the counts and is never held while writing to the store, flushMu keeps a count from being
+// loaded while a flush is on its way to the store
+type usageMeter struct {
+	Quotas map[string]int64
+
+	mu      sync.Mutex
+	flushMu sync.Mutex
+	totals  map[string]int64
+	pending map[string]*usageRecord
+}
+
+// loadUsageMeter parses USAGE_QUOTAS, monthly request quotas per role, e.g. "viewer=50000;api-client=200000"
+func loadUsageMeter() *usageMeter {
+	meter := &usageMeter{Quotas: map[string]int64{}, totals: map[string]int64{}, pending: map[string]*usageRecord{}}
+
+	for _, config := range []string{defaultUsageQuotas, os.Getenv("USAGE_QUOTAS")} {
+		for _, entry := range strings.Split(config, ";") {
+			role, quota, ok := strings.Cut(strings.TrimSpace(entry), "=")
+			if !ok {
+				continue
+			}
+			n, err := strconv.ParseInt(strings.TrimSpace(quota), 10, 64)
+			if err != nil || n < 0 {
+				log.Println("ignoring usage quota", entry)
+				continue
+			}
+			// a quota of 0 lifts the default for the role
+			if n == 0 {
+				delete(meter.Quotas, strings.ToLower(role))
+				continue
+			}
+			meter.Quotas[strings.ToLower(role)] = n
+		}
+	}
+
+	return meter
+}
+
+// usagePrincipal is who a request is charged to, requests with an api key count against its owner so
+// creating more keys doesn't buy more quota
+func usagePrincipal(principal *Principal) string {
+	return "user:" + principal.UserID
+}
+
+func usageKey(month, principal string) string {
+	return month + "|" + principal
+}
+
+// quotaResetAt is the start of the next month, when every quota starts over
+func quotaResetAt(now time.Time) time.Time {
+	now = now.UTC()
+	return time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// quota returns the monthly request quota of the principal, the most generous of its roles,
+// 0 meaning unlimited
+func (app *Config) quota(principal *Principal) int64 {
+	var quota int64
+	for _, role := range app.Policy.roles(principal) {
+		q, ok := app.Usage.Quotas[strings.ToLower(role)]
+		if !ok {
+			return 0
+		}
+		if q > quota {
+			quota = q
+		}
+	}
+	return quota
+}
+
+// used returns the requests counted for key so far, loading the stored count the first time
+func (app *Config) used(key string) (int64, error) {
+	m := app.Usage
+	m.mu.Lock()
+	total, ok := m.totals[key]
+	m.mu.Unlock()
+	if ok {
+		return total, nil
+	}
+
+	// with no flush running every count is either stored or pending
+	m.flushMu.Lock()
+	defer m.flushMu.Unlock()
+
+	var stored usageRecord
+	_, err := app.Store.get(usageBucket, key, &stored)
+	if err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if total, ok := m.totals[key]; ok {
+		return total, nil
+	}
+	total = stored.Requests
+	if pending, ok := m.pending[key]; ok {
+		total += pending.Requests
+	}
+	m.totals[key] = total
+	return total, nil
+}
+
+// count adds one request of the principal on route and network to the pending usage
+func (app *Config) count(month string, principal *Principal, route, network string) {
+	m := app.Usage
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := usageKey(month, usagePrincipal(principal))
+	pending, ok := m.pending[key]
+	if !ok {
+		pending = &usageRecord{
+			Month:     month,
+			Principal: usagePrincipal(principal),
+			UserID:    principal.UserID,
+			Routes:    map[string]int64{},
+			Networks:  map[string]int64{},
+			APIKeys:   map[string]int64{},
+		}
+		m.pending[key] = pending
+	}
+
+	pending.Requests++
+	pending.Routes[route]++
+	if network != "" {
+		pending.Networks[network]++
+	}
+	if principal.APIKeyID != "" {
+		pending.APIKeys[principal.APIKeyID]++
+	}
+	pending.UpdatedAt = time.Now().UTC()
+
+	if _, ok := m.totals[key]; ok {
+		m.totals[key]++
+	}
+}
+
+// flushUsage adds the pending counts to the stored records in a single transaction. The pending counts
+// are taken out under the lock and written without it, so requests are counted on meanwhile
+func (app *Config) flushUsage() error {
+	m := app.Usage
+	m.flushMu.Lock()
+	defer m.flushMu.Unlock()
+
+	m.mu.Lock()
+	batch := m.pending
+	m.pending = map[string]*usageRecord{}
+	m.mu.Unlock()
+
+	if len(batch) > 0 {
+		keys := make([]string, 0, len(batch))
+		for key := range batch {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		stored := map[string]*usageRecord{}
+		err := app.Store.modifyEach(usageBucket, keys, func(key string) any {
+			stored[key] = &usageRecord{}
+			return stored[key]
+		}, func(key string, _ bool) error {
+			stored[key].add(batch[key])
+			return nil
+		})
+
+		// nothing was written, the counts go back to pending for the next flush
+		if err != nil {
+			m.mu.Lock()
+			for key, pending := range batch {
+				if counted, ok := m.pending[key]; ok {
+					pending.add(counted)
+				}
+				m.pending[key] = pending
+			}
+			m.mu.Unlock()
+			return err
+		}
+	}
+
+	// totals of past months are no longer needed to enforce anything
+	month := time.Now().UTC().Format(usageMonthLayout)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key := range m.totals {
+		if !strings.HasPrefix(key, month+"|") {
+			delete(m.totals, key)
+		}
+	}
+	return nil
+}
+
+// persistUsage flushes the pending usage on every tick
+func (app *Config) persistUsage(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := app.flushUsage(); err != nil {
+			log.Println("error persisting usage", err)
+		}
+	}
+}
+
+// meter enforces the monthly quota of the principal and counts its requests by route and network
+func (app *Config) meter(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := principalFrom(r.Context())
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		now := time.Now().UTC()
+		month := now.Format(usageMonthLayout)
+
+		if quota := app.quota(principal); quota > 0 {
+			used, err := app.used(usageKey(month, usagePrincipal(principal)))
+			if err != nil {
+				app.errorJSON(w, err, nil, http.StatusInternalServerError)
+				return
+			}
+
+			// remaining counts this request as already spent
+			reset := int(quotaResetAt(now).Sub(now).Seconds())
+			remaining := max(quota-used-1, 0)
+			w.Header().Set("X-Quota-Limit", strconv.FormatInt(quota, 10))
+			w.Header().Set("X-Quota-Remaining", strconv.FormatInt(remaining, 10))
+			w.Header().Set("X-Quota-Reset", strconv.Itoa(reset))
+
+			if used >= quota {
+				w.Header().Set("Retry-After", strconv.Itoa(reset))
+				app.errorJSON(w, newCodedError("quota.exceeded", "quota", strconv.FormatInt(quota, 10)),
+					map[string]any{"quota": quota, "used": used, "reset_at": quotaResetAt(now)}, http.StatusTooManyRequests)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+
+		// the matched pattern is only known once the router has run
+		route := r.URL.Path
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		app.count(month, principal, r.Method+" "+route, networkFromPath(r.URL.Path))
+	})
+}
+
+// monthFromQuery returns the ?month=YYYY-MM of the request, defaulting to the current month
+func monthFromQuery(r *http.Request) (string, error) {
+	month := r.URL.Query().Get("month")
+	if month == "" {
+		return time.Now().UTC().Format(usageMonthLayout), nil
+	}
+	if _, err := time.Parse(usageMonthLayout, month); err != nil {
+		return "", errors.New("month must be formatted as YYYY-MM")
+	}
+	return month, nil
+}
+
+// usageRecords returns the stored records of month that keep returns true for
+func (app *Config) usageRecords(month string, keep func(usageRecord) bool) ([]usageRecord, error) {
+	err := app.flushUsage()
+	if err != nil {
+		return nil, err
+	}
+
+	records := []usageRecord{}
+	err = app.Store.each(usageBucket, func(key string, value []byte) error {
+		if !strings.HasPrefix(key, month+"|") {
+			return nil
+		}
+		var record usageRecord
+		if err := json.Unmarshal(value, &record); err != nil {
+			return err
+		}
+		if keep(record) {
+			records = append(records, record)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(records, func(i, j int) bool { return records[i].Requests > records[j].Requests })
+	return records, nil
+}
+
+// GetUsage shows the principal its own usage for ?month=YYYY-MM, api keys see the usage of their owner
+// as they share the quota
+func (app *Config) GetUsage(w http.ResponseWriter, r *http.Request) {
+	principal, _ := principalFrom(r.Context())
+
+	month, err := monthFromQuery(r)
+	if err != nil {
+		app.errorJSON(w, err, nil)
+		return
+	}
+
+	records, err := app.usageRecords(month, func(record usageRecord) bool {
+		return record.UserID == principal.UserID
+	})
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+
+	var used int64
+	for _, record := range records {
+		if record.Principal == usagePrincipal(principal) {
+			used = record.Requests
+		}
+	}
+
+	usage := map[string]any{
+		"month":   month,
+		"used":    used,
+		"records": records,
+	}
+	if quota := app.quota(principal); quota > 0 {
+		usage["quota"] = quota
+		usage["remaining"] = max(quota-used, 0)
+	}
+	if month == time.Now().UTC().Format(usageMonthLayout) {
+		usage["reset_at"] = quotaResetAt(time.Now())
+	}
+
+	var payload jsonResponse
+	payload.Error = false
+	payload.StatusCode = http.StatusOK
+	payload.Message = "usage"
+	payload.Data = usage
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+// ExportUsage exports the usage of every principal for ?month=YYYY-MM, as json or with ?format=csv
+// one row per principal total, route and network
+func (app *Config) ExportUsage(w http.ResponseWriter, r *http.Request) {
+	month, err := monthFromQuery(r)
+	if err != nil {
+		app.errorJSON(w, err, nil)
+		return
+	}
+
+	records, err := app.usageRecords(month, func(usageRecord) bool { return true })
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusInternalServerError)
+		return
+	}
+
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		var payload jsonResponse
+		payload.Error = false
+		payload.StatusCode = http.StatusOK
+		payload.Message = "usage export"
+		payload.Data = records
+
+		app.writeJSON(w, http.StatusOK, payload)
+
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="usage-%s.csv"`, month))
+		w.WriteHeader(http.StatusOK)
+
+		out := csv.NewWriter(w)
+		out.Write([]string{"month", "principal", "user_id", "dimension", "name", "requests"})
+		for _, record := range records {
+			row := func(dimension, name string, n int64) {
+				out.Write([]string{record.Month, record.Principal, record.UserID, dimension, name, strconv.FormatInt(n, 10)})
+			}
+
+			row("total", "", record.Requests)
+			for _, route := range sortedKeys(record.Routes) {
+				row("route", route, record.Routes[route])
+			}
+			for _, network := range sortedKeys(record.Networks) {
+				row("network", network, record.Networks[network])
+			}
+			for _, key := range sortedKeys(record.APIKeys) {
+				row("api_key", key, record.APIKeys[key])
+			}
+		}
+		out.Flush()
+
+	default:
+		app.errorJSON(w, errors.New("format must be json or csv"), nil)
+	}
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -2,63 +2,386 @@ package main
 
 import (
 	"fmt"
+	"log"
+	"net/url"
+	"reflect"
 	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
 )
 
-const (
-	minPassword     = 6
-	minEmailLen     = 2
-	minFirstNameLen = 2
-	minLastNameLen  = 2
-	minPhoneLen     = 10
-	iniqueIDLen     = 36
-)
+// payloads declare their rules in a validate tag, e.g. `validate:"required,min=2,max=64"`. Rules
+// other than required are skipped for empty values. regex takes the rest of the tag, commas
+// included, so it has to come last
+const validateTag = "validate"
+
+var e164Regex = regexp.MustCompile(`^\+[1-9][0-9]{1,14}$`)
+
+// compiled regex rules, keyed by their pattern
+var tagRegexes sync.Map
+
+// the outcome of checking the tags of a payload type, every type is checked the first time it is
+// validated so a broken tag fails its requests with an error instead of a panic
+var checkedTags sync.Map
+
+// validationFailed is the code of every response to a payload that failed validation, the fields
+// carry the codes of what was wrong with them
+const validationFailed = "validation.failed"
+
+// fieldError is what is wrong with one field of a payload
+type fieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Param   string `json:"param,omitempty"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Detail  any    `json:"detail,omitempty"`
+
+	params map[string]string
+}
+
+// validationError holds every field that failed, errorJSON returns them as the data of the response
+type validationError struct {
+	Fields []fieldError
+}
+
+// newFieldError fills in the english message of code, params are name, value pairs on top of the
+// field and rule param
+func newFieldError(field, rule, param, code string, params ...string) fieldError {
+	values := messageParams(params)
+	values["field"], values["param"] = field, param
+	return fieldError{Field: field, Rule: rule, Param: param, Code: code, Message: localize(defaultLanguage, code, values), params: values}
+}
+
+func (e *validationError) Error() string {
+	return e.message(defaultLanguage)
+}
+
+func (e *validationError) message(lang string) string {
+	if len(e.Fields) == 1 {
+		return e.Fields[0].Message
+	}
+	return localize(lang, validationFailed, map[string]string{"count": strconv.Itoa(len(e.Fields))})
+}
+
+// localize translates the message of every field, and the details that have messages of their own
+func (e *validationError) localize(lang string) {
+	for i := range e.Fields {
+		field := &e.Fields[i]
+		if field.Code != "" {
+			field.Message = localize(lang, field.Code, field.params)
+		}
+		if detail, ok := field.Detail.(localizable); ok {
+			detail.localize(lang)
+		}
+	}
+}
 
-func (app *Config) ValidateLoginInput(req LoginPayload) map[string]string {
+// validate checks every tagged field of the struct v points to, returning a *validationError listing
+// the fields that failed
+func validate(v any) error {
+	value := reflect.ValueOf(v)
+	for value.Kind() == reflect.Pointer {
+		if value.IsNil() {
+			return nil
+		}
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return nil
+	}
 
-	errors := map[string]string{}
-	if len(req.Email) < minEmailLen {
-		errors["email"] = fmt.Sprintf("%s is required", "email")
+	if err := checkTypeTags(value.Type()); err != nil {
+		return err
 	}
 
-	if len(req.Password) < minPassword {
-		errors["password"] = fmt.Sprintf("password length should be at least %d characters", minPassword)
+	var failed []fieldError
+	if err := validateStruct(value, "", &failed); err != nil {
+		return err
 	}
+	if len(failed) > 0 {
+		return &validationError{Fields: failed}
+	}
+	return nil
+}
 
-	if !isEmailValid(req.Email) {
-		errors["email"] = fmt.Sprintf("%s supplied is invalid", "email")
+// checkTypeTags checks the tags of t once and remembers the outcome
+func checkTypeTags(t reflect.Type) error {
+	if checked, ok := checkedTags.Load(t); ok {
+		err, _ := checked.(error)
+		return err
 	}
 
-	return errors
+	err := checkStructTags(t)
+	if err != nil {
+		err = fmt.Errorf("validate: %s.%w", t.Name(), err)
+		log.Println(err)
+	}
+	checkedTags.Store(t, err)
+	return err
 }
 
-func (app *Config) ValidataSignupInput(req SignupPayload) map[string]string {
+func validateStruct(value reflect.Value, prefix string, failed *[]fieldError) error {
+	t := value.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name := jsonFieldName(field)
+		if name == "-" {
+			continue
+		}
+		name = prefix + name
 
-	errors := map[string]string{}
-	if len(req.FirstName) < minFirstNameLen {
-		errors["first_name"] = fmt.Sprintf("first name length should be at least %d characters", minFirstNameLen)
+		fieldValue := value.Field(i)
+		for fieldValue.Kind() == reflect.Pointer && !fieldValue.IsNil() {
+			fieldValue = fieldValue.Elem()
+		}
+		if fieldValue.Kind() == reflect.Struct && fieldValue.Type().PkgPath() != "time" {
+			if err := validateStruct(fieldValue, name+".", failed); err != nil {
+				return err
+			}
+		}
+
+		tag := field.Tag.Get(validateTag)
+		if tag == "" {
+			continue
+		}
+		for _, rule := range splitRules(tag) {
+			rule, param, _ := strings.Cut(rule, "=")
+			code, params, ok, err := checkRule(rule, param, fieldValue)
+			if err != nil {
+				return fmt.Errorf("validate: %s: %w", name, err)
+			}
+			if !ok {
+				*failed = append(*failed, newFieldError(name, rule, param, code, params...))
+				// one message per field is enough to fix it
+				break
+			}
+		}
 	}
+	return nil
+}
 
-	if len(req.LastName) < minLastNameLen {
-		errors["last_name"] = fmt.Sprintf("last name length should be at least %d characters", minLastNameLen)
+func jsonFieldName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" {
+		return field.Name
 	}
+	return name
+}
 
-	if len(req.Phone) < minPhoneLen {
-		errors["phone"] = fmt.Sprintf("phone length should be at least %d characters", minPhoneLen)
+func splitRules(tag string) []string {
+	var rules []string
+	for tag != "" {
+		if strings.HasPrefix(tag, "regex=") {
+			return append(rules, tag)
+		}
+		rule, rest, _ := strings.Cut(tag, ",")
+		rules = append(rules, strings.TrimSpace(rule))
+		tag = rest
 	}
+	return rules
+}
 
-	if len(req.Email) < minEmailLen {
-		errors["email"] = fmt.Sprintf("%s is required", "email")
+// checkRule reports whether value passes rule, with the message code and params of the reason when
+// it doesn't. The error is for a rule that can't be applied, checkTagRule normally catches those first
+func checkRule(rule, param string, value reflect.Value) (string, []string, bool, error) {
+	if rule == "required" {
+		return "validation.required", nil, !isEmptyValue(value), nil
 	}
+	if isEmptyValue(value) {
+		return "", nil, true, nil
+	}
+
+	switch rule {
+	case "min", "max":
+		limit, err := strconv.ParseFloat(param, 64)
+		if err != nil {
+			return "", nil, false, fmt.Errorf("%s needs a number, got %q", rule, param)
+		}
+		size, unit, ok := measure(value)
+		if !ok {
+			return "", nil, false, fmt.Errorf("%s can't measure a %s", rule, value.Kind())
+		}
+		if rule == "min" && size < limit {
+			return "validation.min" + unit, nil, false, nil
+		}
+		if rule == "max" && size > limit {
+			return "validation.max" + unit, nil, false, nil
+		}
+		return "", nil, true, nil
 
-	// if !isEmailValid(req.Email) {
-	// 	errors["email"] = fmt.Sprintf("%s supplied is invalid", "email")
-	// }
+	case "email":
+		return "validation.email", nil, eachString(value, isEmailValid), nil
 
-	return errors
+	case "e164":
+		return "validation.e164", nil, eachString(value, e164Regex.MatchString), nil
+
+	case "url":
+		return "validation.url", nil, eachString(value, func(s string) bool {
+			u, err := url.Parse(s)
+			return err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != ""
+		}), nil
+
+	case "oneof":
+		options := strings.Fields(param)
+		return "validation.oneof", []string{"options", strings.Join(options, ", ")}, eachString(value, func(s string) bool {
+			for _, option := range options {
+				if s == option {
+					return true
+				}
+			}
+			return false
+		}), nil
+
+	case "tx_hash":
+		return "validation.tx_hash", nil, eachString(value, isTxHash), nil
+
+	case "regex":
+		pattern, err := tagRegex(param)
+		if err != nil {
+			return "", nil, false, err
+		}
+		return "validation.regex", nil, eachString(value, pattern.MatchString), nil
+	}
+
+	return "", nil, false, fmt.Errorf("unknown rule %q", rule)
+}
+
+// tagRegex compiles the pattern of a regex rule once
+func tagRegex(pattern string) (*regexp.Regexp, error) {
+	if compiled, ok := tagRegexes.Load(pattern); ok {
+		return compiled.(*regexp.Regexp), nil
+	}
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("regex %q: %w", pattern, err)
+	}
+	tagRegexes.Store(pattern, compiled)
+	return compiled, nil
+}
+
+func checkStructTags(t reflect.Type) error {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		fieldType := field.Type
+		for fieldType.Kind() == reflect.Pointer {
+			fieldType = fieldType.Elem()
+		}
+		if fieldType.Kind() == reflect.Struct && fieldType.PkgPath() != "time" {
+			if err := checkStructTags(fieldType); err != nil {
+				return fmt.Errorf("%s.%w", field.Name, err)
+			}
+		}
+
+		tag := field.Tag.Get(validateTag)
+		if tag == "" {
+			continue
+		}
+		for _, rule := range splitRules(tag) {
+			rule, param, _ := strings.Cut(rule, "=")
+			if err := checkTagRule(rule, param, fieldType); err != nil {
+				return fmt.Errorf("%s: %w", field.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkTagRule reports what is wrong with rule on a field of type t, before any value is checked with it
+func checkTagRule(rule, param string, t reflect.Type) error {
+	textual := t.Kind() == reflect.String || (t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.String)
+
+	switch rule {
+	case "required":
+		return nil
+
+	case "min", "max":
+		if _, err := strconv.ParseFloat(param, 64); err != nil {
+			return fmt.Errorf("%s needs a number, got %q", rule, param)
+		}
+		switch t.Kind() {
+		case reflect.String, reflect.Slice, reflect.Map, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+			reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+			return nil
+		}
+		return fmt.Errorf("%s can't measure a %s", rule, t.Kind())
+
+	case "email", "e164", "url", "tx_hash", "oneof", "regex":
+		if !textual {
+			return fmt.Errorf("%s only applies to strings, not a %s", rule, t)
+		}
+		if rule == "oneof" && param == "" {
+			return fmt.Errorf("oneof needs options")
+		}
+		if rule == "regex" {
+			_, err := tagRegex(param)
+			return err
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown rule %q", rule)
+}
+
+func isEmptyValue(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.String:
+		return strings.TrimSpace(value.String()) == ""
+	case reflect.Slice, reflect.Map:
+		return value.Len() == 0
+	case reflect.Pointer, reflect.Interface:
+		return value.IsNil()
+	}
+	return value.IsZero()
+}
+
+// measure returns the length of strings in characters and of slices in items, or the number itself,
+// along with the suffix of the message code for that unit. It reports false for values it can't measure
+func measure(value reflect.Value) (float64, string, bool) {
+	switch value.Kind() {
+	case reflect.String:
+		return float64(utf8.RuneCountInString(value.String())), "_length", true
+	case reflect.Slice, reflect.Map:
+		return float64(value.Len()), "_items", true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int()), "", true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint()), "", true
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), "", true
+	}
+	return 0, "", false
+}
+
+// eachString applies check to a string, or to every string of a slice
+func eachString(value reflect.Value, check func(string) bool) bool {
+	switch value.Kind() {
+	case reflect.String:
+		return check(value.String())
+	case reflect.Slice:
+		for i := 0; i < value.Len(); i++ {
+			if item := value.Index(i); item.Kind() != reflect.String || !check(item.String()) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
 }
 
+// isEmailValid accepts a bare address, no display name or angle brackets, with a valid domain
 func isEmailValid(e string) bool {
-	emailRegex := regexp.MustCompile(`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,4}$`)
-	return emailRegex.MatchString(e)
+	_, err := canonicalEmail(e)
+	return err == nil
 }
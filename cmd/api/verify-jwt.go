@@ -7,6 +7,41 @@ import (
 )
 
 func (app *Config) getUserToken(w http.ResponseWriter, r *http.Request) (jsonResponse, error) {
+	//tokens minted by the broker itself are always verified locally
+	if app.Tokens != nil {
+		if token, err := bearerToken(r); err == nil && app.Tokens.issued(token) {
+			claims, err := app.Tokens.verify(token)
+			if err != nil {
+				return jsonResponse{Error: true, Message: err.Error(), StatusCode: http.StatusUnauthorized, Data: nil}, err
+			}
+			return jsonResponse{Error: false, Message: "token verified", StatusCode: http.StatusOK, Data: map[string]any(claims)}, nil
+		}
+	}
+
+	//without a local verifier every token is checked by the auth service
+	if app.Verifier == nil {
+		return app.remoteUserToken(r)
+	}
+
+	token, err := bearerToken(r)
+	if err != nil {
+		return jsonResponse{Error: true, Message: err.Error(), StatusCode: http.StatusUnauthorized, Data: nil}, err
+	}
+
+	claims, err := app.Verifier.verify(token)
+	if err != nil {
+		//tokens the broker can't verify itself may still be valid for the auth service
+		if app.Verifier.RemoteFallback {
+			return app.remoteUserToken(r)
+		}
+		return jsonResponse{Error: true, Message: err.Error(), StatusCode: http.StatusUnauthorized, Data: nil}, err
+	}
+
+	return jsonResponse{Error: false, Message: "token verified", StatusCode: http.StatusOK, Data: map[string]any(claims)}, nil
+}
+
+// remoteUserToken asks the auth service to verify the token of the request
+func (app *Config) remoteUserToken(r *http.Request) (jsonResponse, error) {
 	//get authorization hearder
 	authorizationHeader := r.Header.Get("Authorization")
 
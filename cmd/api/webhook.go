@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+var errWebhookAddress = errors.New("webhook_url must point to a public address")
+
+// carrier grade nat, net.IP has no method for it
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// webhookClient only connects to public addresses, the address is checked again when dialing so a
+// name that resolves to something else by then is refused as well. Redirects are not followed, they
+// could point anywhere
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !publicAddress(ip) {
+					return errWebhookAddress
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 5 * time.Second,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       time.Minute,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// publicAddress is false for loopback, private, link local and other addresses that are not reachable
+// from the internet, a webhook has no business calling into the network the broker runs in
+func publicAddress(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() && !ip.IsUnspecified() && !sharedAddressSpace.Contains(ip)
+}
+
+// checkWebhookURL accepts https urls whose host only resolves to public addresses
+func checkWebhookURL(ctx context.Context, raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return errors.New("webhook_url is not a valid url")
+	}
+	if u.Scheme != "https" {
+		return errors.New("webhook_url must use https")
+	}
+	if u.User != nil {
+		return errors.New("webhook_url must not contain credentials")
+	}
+
+	host := u.Hostname()
+	if ip := net.ParseIP(host); ip != nil {
+		if !publicAddress(ip) {
+			return errWebhookAddress
+		}
+		return nil
+	}
+
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil || len(addresses) == 0 {
+		return fmt.Errorf("webhook_url host %s could not be resolved", host)
+	}
+	for _, address := range addresses {
+		if !publicAddress(address.IP) {
+			return errWebhookAddress
+		}
+	}
+	return nil
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	transferTopic          = "0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef"
+	withdrawTopic          = "0xebff2602b3f468259e1e99f613fed6691f3a6526effe6ef3e768ba7ae7a36c4f"
+	getLastChildBlockCall  = "0xb87e1b66"
+	zeroAddressTopic       = "0x0000000000000000000000000000000000000000000000000000000000000000"
+	checkpointSampleWindow = 10
+)
+
+// withdrawal stages, in the order a withdrawal moves through them
+const (
+	withdrawalSubmitted    = "submitted"
+	withdrawalBurned       = "burned"
+	withdrawalCheckpointed = "checkpointed"
+	withdrawalClaimable    = "claimable"
+	withdrawalFailed       = "failed"
+)
+
+type TrackWithdrawalPayload struct {
+	TxHash     string `json:"tx_hash" validate:"required,tx_hash"`
+	WebhookURL string `json:"webhook_url,omitempty" validate:"url,max=2048"`
+}
+
+type withdrawalStatus struct {
+	Network                string        `json:"network"`
+	TxHash                 string        `json:"tx_hash"`
+	Stage                  string        `json:"stage"`
+	BlockNumber            uint64        `json:"block_number,omitempty"`
+	CheckpointID           uint64        `json:"checkpoint_id,omitempty"`
+	LastCheckpointedBlock  uint64        `json:"last_checkpointed_block,omitempty"`
+	NextCheckpointExpected *time.Time    `json:"next_checkpoint_expected_at,omitempty"`
+	SecondsToNext          int64         `json:"seconds_to_next_checkpoint,omitempty"`
+	ClaimableAt            *time.Time    `json:"claimable_at,omitempty"`
+	WebhookURL             string        `json:"webhook_url,omitempty"`
+	Stages                 []bridgeStage `json:"stages"`
+	Error                  string        `json:"error,omitempty"`
+	TrackedAt              time.Time     `json:"tracked_at"`
+	UpdatedAt              time.Time     `json:"updated_at"`
+}
+
+// advance moves the withdrawal to stage, keeping the time it was first reached
+func (wd *withdrawalStatus) advance(stage string, at time.Time) {
+	for _, s := range wd.Stages {
+		if s.Stage == stage {
+			return
+		}
+	}
+	wd.Stage = stage
+	wd.Stages = append(wd.Stages, bridgeStage{Stage: stage, At: at.UTC()})
+}
+
+func (wd *withdrawalStatus) final() bool {
+	return wd.Stage == withdrawalClaimable || wd.Stage == withdrawalFailed
+}
+
+func (app *Config) TrackWithdrawal(w http.ResponseWriter, r *http.Request) {
+
+	network, err := app.network(r)
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusNotFound)
+		return
+	}
+
+	var requestPayload TrackWithdrawalPayload
+	err = app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err, nil)
+		return
+	}
+
+	if requestPayload.WebhookURL != "" {
+		err = checkWebhookURL(r.Context(), requestPayload.WebhookURL)
+		if err != nil {
+			app.errorJSON(w, err, nil)
+			return
+		}
+	}
+
+	principal, _ := principalFrom(r.Context())
+	wd, ok := app.Bridge.withdrawal(network.Name, requestPayload.TxHash)
+	if !ok {
+		wd = withdrawalStatus{Network: network.Name, TxHash: normalizeTxHash(requestPayload.TxHash), TrackedAt: time.Now().UTC()}
+		wd.advance(withdrawalSubmitted, wd.TrackedAt)
+	}
+
+	refreshed, err := refreshWithdrawal(r.Context(), network, wd)
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusBadGateway)
+		return
+	}
+	err = app.Bridge.trackWithdrawal(refreshed, principal.UserID, requestPayload.WebhookURL)
+	if err != nil {
+		app.errorJSON(w, err, nil, trackingErrorStatus(err))
+		return
+	}
+	notifyStageChange(wd, refreshed, app.Bridge.webhooks(network.Name, refreshed.TxHash))
+	refreshed.WebhookURL = app.Bridge.webhook(network.Name, refreshed.TxHash, principal.UserID)
+
+	var payload jsonResponse
+	payload.Error = false
+	payload.StatusCode = http.StatusAccepted
+	payload.Message = fmt.Sprintf("withdrawal is being tracked, current stage: %s", refreshed.Stage)
+	payload.Data = refreshed
+
+	app.writeJSON(w, http.StatusAccepted, payload)
+}
+
+func (app *Config) GetWithdrawal(w http.ResponseWriter, r *http.Request) {
+
+	network, err := app.network(r)
+	if err != nil {
+		app.errorJSON(w, err, nil, http.StatusNotFound)
+		return
+	}
+
+	//users only see the transfers they track themselves
+	principal, _ := principalFrom(r.Context())
+	wd, ok := app.Bridge.withdrawal(network.Name, chi.URLParam(r, "txHash"))
+	if !ok || !app.Bridge.watching("withdrawal", network.Name, wd.TxHash, principal.UserID) {
+		app.errorJSON(w, errors.New("withdrawal is not being tracked, submit it first"), nil, http.StatusNotFound)
+		return
+	}
+
+	if !wd.final() {
+		refreshed, err := refreshWithdrawal(r.Context(), network, wd)
+		if err == nil {
+			app.Bridge.saveWithdrawal(refreshed)
+			notifyStageChange(wd, refreshed, app.Bridge.webhooks(network.Name, refreshed.TxHash))
+			wd = refreshed
+		}
+	}
+	wd.WebhookURL = app.Bridge.webhook(network.Name, wd.TxHash, principal.UserID)
+
+	var payload jsonResponse
+	payload.Error = false
+	payload.StatusCode = http.StatusOK
+	payload.Message = fmt.Sprintf("current stage: %s", wd.Stage)
+	payload.Data = wd
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+// refreshWithdrawal follows a burn on bor until its checkpoint lands on L1 and the exit can be claimed
+func refreshWithdrawal(ctx context.Context, network *posNetwork, wd withdrawalStatus) (withdrawalStatus, error) {
+	if network == nil {
+		return wd, fmt.Errorf("unknown network %s", wd.Network)
+	}
+	wd.UpdatedAt = time.Now().UTC()
+
+	if wd.BlockNumber == 0 {
+		var receipt *struct {
+			Status      string `json:"status"`
+			BlockNumber string `json:"blockNumber"`
+			Logs        []struct {
+				Topics []string `json:"topics"`
+			} `json:"logs"`
+		}
+		err := rpcCall(ctx, network.BorRPCURL, "eth_getTransactionReceipt", []any{wd.TxHash}, &receipt)
+		if err != nil {
+			return wd, err
+		}
+		// still waiting to be mined on bor
+		if receipt == nil {
+			return wd, nil
+		}
+
+		if receipt.Status == "0x0" {
+			wd.Error = "burn transaction reverted on bor"
+			wd.advance(withdrawalFailed, wd.UpdatedAt)
+			return wd, nil
+		}
+
+		// a burn either emits the child token Withdraw event or an erc20/erc721 transfer to the zero address
+		burned := false
+		for _, l := range receipt.Logs {
+			if len(l.Topics) == 0 {
+				continue
+			}
+			if strings.EqualFold(l.Topics[0], withdrawTopic) || (strings.EqualFold(l.Topics[0], transferTopic) && len(l.Topics) > 2 && l.Topics[2] == zeroAddressTopic) {
+				burned = true
+				break
+			}
+		}
+		if !burned {
+			wd.Error = "transaction did not burn any tokens, it is not a bridge withdrawal"
+			wd.advance(withdrawalFailed, wd.UpdatedAt)
+			return wd, nil
+		}
+
+		wd.BlockNumber, _ = hexUint64(receipt.BlockNumber)
+		burnedAt := wd.UpdatedAt
+		var borBlock struct {
+			Timestamp string `json:"timestamp"`
+		}
+		err = rpcCall(ctx, network.BorRPCURL, "eth_getBlockByNumber", []any{receipt.BlockNumber, false}, &borBlock)
+		if err == nil {
+			if ts, err := hexUint64(borBlock.Timestamp); err == nil {
+				burnedAt = time.Unix(int64(ts), 0)
+			}
+		}
+		wd.advance(withdrawalBurned, burnedAt)
+	}
+
+	cp, lastCheckpointed, err := findCheckpoint(ctx, network, wd.BlockNumber)
+	wd.LastCheckpointedBlock = lastCheckpointed
+	if errors.Is(err, errBlockNotCheckpointed) {
+		expected, err := nextCheckpointExpected(ctx, network)
+		//the exit can only be claimed once a checkpoint covers the burn, until then the estimate is
+		//for the next checkpoint alone and not when the exit becomes claimable
+		wd.ClaimableAt = nil
+		if err == nil {
+			wd.NextCheckpointExpected = &expected
+			wd.SecondsToNext = int64(time.Until(expected).Seconds())
+			if wd.SecondsToNext < 0 {
+				wd.SecondsToNext = 0
+			}
+		}
+		return wd, nil
+	}
+	if err != nil {
+		return wd, err
+	}
+
+	wd.CheckpointID = cp.ID
+	wd.NextCheckpointExpected = nil
+	wd.SecondsToNext = 0
+	checkpointedAt := time.Unix(int64(cp.Timestamp), 0)
+	wd.advance(withdrawalCheckpointed, checkpointedAt)
+
+	// heimdall only acknowledges a checkpoint after it was submitted to the rootchain, when an L1
+	// endpoint is configured confirm it there and use the L1 submission time
+	claimableAt := checkpointedAt
+	if network.EthRPCURL != "" {
+		out, err := ethCall(ctx, network.EthRPCURL, network.RootChainAddress, getLastChildBlockCall)
+		if err != nil || wordToUint64(abiWord(out, 0)) < wd.BlockNumber {
+			return wd, nil
+		}
+		if submission, err := rootChainSubmission(ctx, network, cp.ID); err == nil {
+			claimableAt = submission.CreatedAt
+		}
+	}
+	claimableAt = claimableAt.UTC()
+	wd.ClaimableAt = &claimableAt
+	wd.advance(withdrawalClaimable, claimableAt)
+
+	return wd, nil
+}
+
+// nextCheckpointExpected estimates the next checkpoint from the average interval of the most recent ones
+func nextCheckpointExpected(ctx context.Context, network *posNetwork) (time.Time, error) {
+	count, err := checkpointCount(ctx, network)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if count < 2 {
+		return time.Time{}, errors.New("not enough checkpoints to estimate the interval")
+	}
+
+	first := uint64(1)
+	if count > checkpointSampleWindow {
+		first = count - checkpointSampleWindow
+	}
+
+	oldest, err := checkpointByID(ctx, network, first)
+	if err != nil {
+		return time.Time{}, err
+	}
+	latest, err := checkpointByID(ctx, network, count)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	interval := time.Duration(int64(latest.Timestamp)-int64(oldest.Timestamp)) * time.Second / time.Duration(count-first)
+	expected := time.Unix(int64(latest.Timestamp), 0).Add(interval).UTC()
+	if expected.Before(time.Now()) {
+		// overdue, the checkpoint is expected any moment
+		expected = time.Now().UTC()
+	}
+	return expected, nil
+}
+
+// notifyStageChange posts the withdrawal to the webhooks of the users following it when the stage moved
+func notifyStageChange(before, after withdrawalStatus, webhooks []string) {
+	if before.Stage == after.Stage {
+		return
+	}
+	for _, url := range webhooks {
+		go postWebhook(url, before.Stage, after)
+	}
+}
+
+// postWebhook sends a stage change to a single webhook, each receiver only sees its own url in it
+func postWebhook(url, previousStage string, wd withdrawalStatus) {
+	wd.WebhookURL = url
+	body, err := json.Marshal(map[string]any{
+		"event":          "withdrawal.stage_changed",
+		"previous_stage": previousStage,
+		"withdrawal":     wd,
+	})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	request, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	// let receivers check the notification came from the broker
+	if secret := os.Getenv("WEBHOOK_SECRET"); secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		request.Header.Set("X-Broker-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	response, err := webhookClient.Do(request)
+	if err != nil {
+		log.Println("error calling withdrawal webhook", url, err)
+		return
+	}
+	response.Body.Close()
+}
@@ -3,6 +3,14 @@ module github.com/obynonwane/polygon_swiftlink_broker_api
 go 1.21.0
 
 require (
+	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.3.0
 	github.com/go-chi/chi/v5 v5.1.0
 	github.com/go-chi/cors v1.2.1
+	github.com/golang-jwt/jwt/v5 v5.2.1
+	go.etcd.io/bbolt v1.3.10
+	golang.org/x/crypto v0.24.0
+	golang.org/x/net v0.26.0
+	golang.org/x/text v0.16.0
 )
+
+require golang.org/x/sys v0.21.0 // indirect